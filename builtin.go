@@ -0,0 +1,148 @@
+package cpre
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MacroContext describes where a macro implemented by a MacroFunc is
+// expanded.
+type MacroContext struct {
+	Name         string
+	File         string
+	Line         int
+	IncludeLevel int
+}
+
+// MacroFunc computes the replacement of a macro from the spellings of its
+// arguments; the replacement is rescanned for further macros.
+type MacroFunc func(ctx MacroContext, args []string) (string, error)
+
+// call expands an invocation of a macro implemented by a MacroFunc; an error
+// is reported and the invocation expands to nothing.
+func (e *expander) call(m *macro, args [][]token, hs hideset) []token {
+	line, _ := e.s.location(e.s.end)
+
+	ctx := MacroContext{
+		Name:         m.name,
+		File:         e.s.file,
+		Line:         line,
+		IncludeLevel: e.s.depth,
+	}
+
+	var ss []string
+	for _, arg := range args {
+		ss = append(ss, spelling(arg))
+	}
+
+	text, err := m.fn(ctx, ss)
+	if err != nil {
+		e.s.errorf("%s", errors.Wrapf(err, "failed to expand macro: '%s'", m.name))
+		return nil
+	}
+
+	ts := tokenize(text)
+	for i := range ts {
+		ts[i].hide = ts[i].hide.union(hs)
+	}
+
+	return ts
+}
+
+// builtins computes the value of the predefined dynamic macros on each
+// expansion.
+var builtins = map[string]func(s *state) string{
+	"__FILE__": func(s *state) string {
+		return `"` + stringEscaper.Replace(s.file) + `"`
+	},
+	"__LINE__": func(s *state) string {
+		line, _ := s.location(s.end)
+		return strconv.Itoa(line)
+	},
+	"__COUNTER__": func(s *state) string {
+		counter := s.p.counter
+		s.p.counter++
+		return strconv.Itoa(counter)
+	},
+	"__INCLUDE_LEVEL__": func(s *state) string {
+		return strconv.Itoa(s.depth)
+	},
+	"__DATE__": func(s *state) string {
+		t, ok := s.time()
+		if !ok {
+			return `"??? ?? ????"`
+		}
+		return t.Format(`"Jan _2 2006"`)
+	},
+	"__TIME__": func(s *state) string {
+		t, ok := s.time()
+		if !ok {
+			return `"??:??:??"`
+		}
+		return t.Format(`"15:04:05"`)
+	},
+}
+
+func (p *Preprocessor) defineBuiltins() {
+	for name, fn := range builtins {
+		p.defines[name] = &macro{
+			name:    name,
+			builtin: fn,
+		}
+	}
+
+	p.Define("__STDC_EMBED_NOT_FOUND__", strconv.Itoa(embedNotFound))
+	p.Define("__STDC_EMBED_FOUND__", strconv.Itoa(embedFound))
+	p.Define("__STDC_EMBED_EMPTY__", strconv.Itoa(embedEmpty))
+}
+
+// sourceDateEpoch returns the time set by the SOURCE_DATE_EPOCH environment
+// variable, if any, for reproducible builds.
+func sourceDateEpoch() (time.Time, bool, error) {
+	v, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	epoch, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || epoch < 0 {
+		return time.Time{}, false, errors.Errorf("environment variable SOURCE_DATE_EPOCH must expand to a non-negative integer: '%s'", v)
+	}
+
+	return time.Unix(epoch, 0).UTC(), true, nil
+}
+
+// time returns the time of translation used by __DATE__ and __TIME__; it is
+// determined once per file, on first use, and is unknown if
+// SOURCE_DATE_EPOCH is invalid.
+func (s *state) time() (time.Time, bool) {
+	p := s.p
+
+	if p.timeSet {
+		return p.time, !p.time.IsZero()
+	}
+
+	p.timeSet = true
+
+	switch {
+	case p.now != nil:
+		p.time = p.now()
+	default:
+		t, ok, err := sourceDateEpoch()
+		if err != nil {
+			s.errorf("%s", err)
+			return time.Time{}, false
+		}
+
+		if ok {
+			p.time = t
+		} else {
+			p.time = time.Now()
+		}
+	}
+
+	return p.time, true
+}
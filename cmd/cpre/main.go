@@ -13,8 +13,12 @@ import (
 type includes []string
 
 type args struct {
-	Path    string
-	Include includes
+	Path        string
+	Include     includes
+	Quote       includes
+	System      includes
+	After       includes
+	LineMarkers bool
 }
 
 func (i *includes) Set(value string) error {
@@ -32,7 +36,13 @@ func run(a args) error {
 	}
 
 	p := cpre.NewPreprocessor(cpre.PreprocessorConfig{
-		Include: cpre.NewIncluder(a.Include),
+		Include: cpre.NewIncluderWithConfig(cpre.IncluderConfig{
+			Quote:  a.Quote,
+			Paths:  a.Include,
+			System: a.System,
+			After:  a.After,
+		}),
+		LineMarkers: a.LineMarkers,
 	})
 
 	bs, err := os.ReadFile(a.Path)
@@ -40,7 +50,15 @@ func run(a args) error {
 		return errors.Wrapf(err, "failed to read file: '%s'", a.Path)
 	}
 
-	processed := p.Process(string(bs))
+	processed, diagnostics, err := p.ProcessFile(a.Path, string(bs))
+
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, d)
+	}
+
+	if err != nil {
+		return errors.Errorf("failed to preprocess file: '%s'", a.Path)
+	}
 
 	fmt.Println(string(processed))
 
@@ -52,6 +70,11 @@ func main() {
 
 	flag.StringVar(&a.Path, "path", "", "path to the file to be processed; required")
 	flag.Var(&a.Include, "include", "include path; can be specified multiple times")
+	flag.Var(&a.Quote, "iquote", "include path for \"...\" includes only; can be specified multiple times")
+	flag.Var(&a.System, "isystem", "system include path, searched after -include; can be specified multiple times")
+	flag.Var(&a.After, "idirafter", "include path searched last; can be specified multiple times")
+
+	flag.BoolVar(&a.LineMarkers, "linemarkers", false, "emit linemarkers for included files, skipped blocks and #line directives")
 
 	flag.Parse()
 
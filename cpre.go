@@ -1,10 +1,11 @@
 package cpre
 
 import (
-	"os"
-	"path/filepath"
+	"bytes"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/dragmz/cpre/eval"
@@ -24,79 +25,264 @@ type block struct {
 	kind   blockKind
 	skip   bool
 	value  bool
-}
 
-type Includer func(filePath string, global bool) (id string, source []byte, err error)
+	line   int
+	column int
+}
 
 type Preprocessor struct {
-	defines map[string]string
+	defines map[string]*macro
 	stack   *block
 
-	include  Includer
-	includes map[string]bool
+	include Includer
+	// once holds the ids of the files marked with #pragma once
+	once map[string]bool
+	// guards maps the ids of included files to the macro names of their
+	// include guards
+	guards map[string]string
+	// resolved caches the ids of included files, so that guarded files are
+	// skipped without calling the includer again
+	resolved map[includeKey]string
+
+	lineMarkers bool
+
+	maxIncludeDepth int
+
+	// pushed holds the definitions saved by PushMacro; nil stands for an
+	// undefined macro
+	pushed map[string][]*macro
+
+	directives map[string]DirectiveHandler
+	pragmas    map[string]PragmaHandler
+
+	now     func() time.Time
+	time    time.Time
+	timeSet bool
+	counter int
+
+	diagnostics []Diagnostic
+}
+
+// includeKey identifies an #include by its arguments to the includer.
+type includeKey struct {
+	path     string
+	global   bool
+	includer string
+	from     int
 }
 
 type PreprocessorConfig struct {
 	Include Includer
+	// LineMarkers enables GCC-style linemarkers in the output, e.g.
+	// # 42 "foo.h" 1, when entering and leaving included files, after
+	// skipped blocks and for #line directives.
+	LineMarkers bool
+	// MaxIncludeDepth limits the nesting of #include; the default is 200.
+	MaxIncludeDepth int
+	// Now, when set, returns the time of translation for __DATE__ and
+	// __TIME__; otherwise SOURCE_DATE_EPOCH or the current time is used.
+	Now func() time.Time
 }
 
-func NewIncluder(paths []string) Includer {
-	return func(name string, global bool) (string, []byte, error) {
-		for _, dir := range paths {
-			ip := filepath.Join(dir, name)
+func NewPreprocessor(config PreprocessorConfig) *Preprocessor {
+	p := &Preprocessor{
+		defines: make(map[string]*macro),
+		stack:   &block{},
+
+		include: config.Include,
+		once:    map[string]bool{},
+		guards:  map[string]string{},
 
-			id, err := filepath.Abs(ip)
-			if err != nil {
-				return "", nil, errors.Wrapf(err, "failed to resolve #include file: '%s'", name)
-			}
+		resolved: map[includeKey]string{},
 
-			bs, err := os.ReadFile(ip)
-			if os.IsNotExist(err) {
-				continue
-			}
+		lineMarkers: config.LineMarkers,
 
-			if err != nil {
-				return "", nil, errors.Wrapf(err, "failed to read #include file: '%s'", name)
-			}
+		maxIncludeDepth: config.MaxIncludeDepth,
 
-			return id, bs, nil
-		}
+		pushed: map[string][]*macro{},
+
+		directives: map[string]DirectiveHandler{},
+		pragmas:    map[string]PragmaHandler{},
+
+		now: config.Now,
+	}
+
+	if p.maxIncludeDepth <= 0 {
+		p.maxIncludeDepth = 200
+	}
+
+	p.defineBuiltins()
+
+	return p
+}
 
-		return "", nil, errors.Errorf("failed to find #include file: '%s'", name)
+// Define defines a macro; id may include a parameter list, e.g. "MAX(a,b)",
+// to define a function-like macro.
+func (p *Preprocessor) Define(id, value string) error {
+	m, err := parseMacro(id + " " + value)
+	if err != nil {
+		return errors.Wrapf(err, "failed to define macro: '%s'", id)
 	}
+
+	p.defines[m.name] = m
+
+	return nil
 }
 
-func NewPreprocessor(config PreprocessorConfig) *Preprocessor {
-	return &Preprocessor{
-		defines: make(map[string]string),
-		stack:   &block{},
+// DefineFunc defines a macro whose replacement is computed by fn on each
+// expansion; like with Define, id may include a parameter list, e.g.
+// "JOIN(...)", to define a function-like macro, and errors returned by fn
+// are reported as diagnostics.
+func (p *Preprocessor) DefineFunc(id string, fn MacroFunc) error {
+	m, err := parseMacro(id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to define macro: '%s'", id)
+	}
 
-		include:  config.Include,
-		includes: map[string]bool{},
+	if len(m.body) > 0 {
+		return errors.Errorf("failed to define macro: '%s': unexpected replacement list", id)
 	}
+
+	m.fn = fn
+	p.defines[m.name] = m
+
+	return nil
 }
 
-func (p *Preprocessor) Define(id, value string) {
-	p.defines[id] = value
+func (p *Preprocessor) defined(id string) bool {
+	switch id {
+	case "__has_include", "__has_include_next", "__has_embed":
+		// the operators are defined, so that their support can be tested
+		return true
+	}
+
+	_, ok := p.defines[id]
+	return ok
 }
 
 func (p *Preprocessor) Undefine(id string) {
 	delete(p.defines, id)
 }
 
+// PushMacro saves the current definition of a macro, if any, to be restored
+// by PopMacro.
+func (p *Preprocessor) PushMacro(id string) {
+	p.pushed[id] = append(p.pushed[id], p.defines[id])
+}
+
+// PopMacro restores the definition of a macro saved by the last PushMacro;
+// the macro is undefined if it was not defined when pushed.
+func (p *Preprocessor) PopMacro(id string) error {
+	pushed := p.pushed[id]
+	if len(pushed) == 0 {
+		return errors.Errorf("macro '%s' was not pushed", id)
+	}
+
+	m := pushed[len(pushed)-1]
+	p.pushed[id] = pushed[:len(pushed)-1]
+
+	if m == nil {
+		delete(p.defines, id)
+	} else {
+		p.defines[id] = m
+	}
+
+	return nil
+}
+
+// Process preprocesses source; any diagnostics are discarded.
 func (p *Preprocessor) Process(source string) string {
-	source = strings.ReplaceAll(source, "\r\n", "\n")
+	result, _, _ := p.ProcessFile("", source)
+	return result
+}
 
-	bs := []byte(source)
+// ProcessWithDiagnostics preprocesses source and returns the diagnostics
+// reported along the way; err is non-nil if any of them is an error.
+func (p *Preprocessor) ProcessWithDiagnostics(source string) (string, []Diagnostic, error) {
+	return p.ProcessFile("", source)
+}
+
+// ProcessFile is like ProcessWithDiagnostics, with id identifying the file
+// the source was read from in diagnostics.
+func (p *Preprocessor) ProcessFile(id, source string) (string, []Diagnostic, error) {
+	bs := normalize(source)
+
+	p.diagnostics = nil
+	p.timeSet = false
 
 	s := &state{
 		p:     p,
 		s:     bs,
 		start: 0,
 		end:   0,
+
+		id:    id,
+		file:  id,
+		line:  1,
+		index: -1,
+	}
+
+	marker := s.marker(1, "")
+
+	result := s.process()
+
+	if p.lineMarkers {
+		result = marker + "\n" + result
+	}
+
+	diagnostics := p.diagnostics
+	p.diagnostics = nil
+
+	var errs []string
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, diagnostics, errors.Errorf("preprocessing failed with %d error(s):\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	return result, diagnostics, nil
+}
+
+// normalize converts line endings to \n and splices lines ending with a
+// backslash with the following line; the removed newlines are re-inserted
+// after the logical line, so that the lines following it keep their
+// original line numbers.
+func normalize(source string) []byte {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+
+	result := make([]byte, 0, len(source))
+
+	spliced := 0
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+
+		if c == '\\' {
+			// like GCC, allow whitespace between the backslash and the newline
+			j := i + 1
+			for j < len(source) && (source[j] == ' ' || source[j] == '\t') {
+				j++
+			}
+
+			if j < len(source) && source[j] == '\n' {
+				spliced++
+				i = j
+				continue
+			}
+		}
+
+		result = append(result, c)
+
+		if c == '\n' && spliced > 0 {
+			result = append(result, bytes.Repeat([]byte("\n"), spliced)...)
+			spliced = 0
+		}
 	}
 
-	return s.process()
+	return append(result, bytes.Repeat([]byte("\n"), spliced)...)
 }
 
 func (p *Preprocessor) push() *block {
@@ -110,6 +296,13 @@ func (p *Preprocessor) push() *block {
 	return previous
 }
 
+// guarded reports whether the file would expand to nothing, being marked
+// with #pragma once or having its include guard defined.
+func (p *Preprocessor) guarded(id string) bool {
+	guard, ok := p.guards[id]
+	return p.once[id] || ok && p.defined(guard)
+}
+
 func (p *Preprocessor) pop() *block {
 	previous := p.stack
 	p.stack = p.stack.parent
@@ -123,7 +316,105 @@ type state struct {
 	start int
 	end   int
 
-	once bool
+	newlines int
+
+	// pos is the start of the directive or macro invocation being processed
+	pos int
+
+	id     string
+	line   int
+	lineAt int
+
+	// file is the file name reported in diagnostics and linemarkers, as
+	// set by #line
+	file string
+	// depth is the include depth, 0 for the main file
+	depth int
+	// parent is the state of the including file
+	parent *state
+	// index is the index of the search path the file was found in, or -1
+	index int
+}
+
+// next returns the index of the search path to start searching at for
+// #include_next, i.e. the one following the path of the current file; 0,
+// skipping the includer's directory, if the file was found there, and -1,
+// searching like #include, for the main file.
+func (s *state) next() int {
+	if s.parent == nil {
+		return -1
+	}
+
+	if s.index < 0 {
+		return 0
+	}
+
+	return s.index + 1
+}
+
+// includeChain returns the ids of the files being included, starting with
+// the main file.
+func (s *state) includeChain() []string {
+	var chain []string
+	for is := s; is != nil; is = is.parent {
+		chain = append([]string{is.id}, chain...)
+	}
+
+	return chain
+}
+
+// sync counts the lines consumed up to the current position.
+func (s *state) sync() {
+	if s.lineAt <= s.end {
+		s.line += bytes.Count(s.s[s.lineAt:s.end], []byte("\n"))
+	} else {
+		s.line -= bytes.Count(s.s[s.end:s.lineAt], []byte("\n"))
+	}
+	s.lineAt = s.end
+}
+
+// location returns the line and column of pos, which must not be past the
+// current position.
+func (s *state) location(pos int) (int, int) {
+	s.sync()
+
+	line := s.line - bytes.Count(s.s[pos:s.end], []byte("\n"))
+	column := pos - bytes.LastIndexByte(s.s[:pos], '\n')
+
+	return line, column
+}
+
+// replace replaces the source from start up to the current position with
+// text and moves past it; the replaced text keeps counting towards the line.
+func (s *state) replace(start int, text []byte) {
+	s.sync()
+
+	s.s = append(s.s[:start], append(text, s.s[s.end:]...)...)
+	s.end = start + len(text)
+	s.lineAt = s.end
+}
+
+func (s *state) report(severity Severity, format string, args ...interface{}) {
+	line, column := s.location(s.pos)
+	s.reportAt(line, column, severity, format, args...)
+}
+
+func (s *state) reportAt(line, column int, severity Severity, format string, args ...interface{}) {
+	s.p.diagnostics = append(s.p.diagnostics, Diagnostic{
+		File:     s.file,
+		Line:     line,
+		Column:   column,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (s *state) errorf(format string, args ...interface{}) {
+	s.report(SeverityError, format, args...)
+}
+
+func (s *state) warningf(format string, args ...interface{}) {
+	s.report(SeverityWarning, format, args...)
 }
 
 func (p *state) skipWhitespace() {
@@ -188,7 +479,33 @@ func (p *state) readID() string {
 	return id
 }
 
+// readToEOL reads the rest of a directive; block comments may span lines
+// and are read as a single space, like the other comments, while the
+// newlines in them are kept in the output through newlines.
 func (p *state) readToEOL() string {
+	var sb strings.Builder
+	sb.Write(p.s[p.start:p.end])
+
+	for p.end < len(p.s) {
+		t, end := scanToken(p.s, p.end)
+		if t.kind == tokenKindNewline {
+			break
+		}
+
+		if t.kind == tokenKindSpace && (strings.HasPrefix(t.text, "/*") || strings.HasPrefix(t.text, "//")) {
+			p.newlines += strings.Count(t.text, "\n")
+			t.text = " "
+		}
+
+		sb.WriteString(t.text)
+		p.end = end
+	}
+
+	return sb.String()
+}
+
+// readLine reads the rest of the line as is.
+func (p *state) readLine() string {
 	for p.end < len(p.s) {
 		r, w := utf8.DecodeRune(p.s[p.end:])
 
@@ -201,12 +518,170 @@ func (p *state) readToEOL() string {
 	return string(p.s[p.start:p.end])
 }
 
+// marker returns a linemarker stating that the next line is the given line
+// of the current file.
+func (s *state) marker(line int, flags string) string {
+	m := fmt.Sprintf("# %d \"%s\"", line, stringEscaper.Replace(s.file))
+	if flags != "" {
+		m += " " + flags
+	}
+
+	return m
+}
+
+// setLine implements #line: the line following the directive gets the given
+// number and optionally a new file name.
+func (s *state) setLine(value string) {
+	var ts []token
+	for _, t := range s.expandTokens(tokenize(value)) {
+		if t.kind != tokenKindSpace {
+			ts = append(ts, t)
+		}
+	}
+
+	if len(ts) == 0 || ts[0].kind != tokenKindNumber || strings.Trim(ts[0].text, "0123456789") != "" {
+		s.errorf("#line directive requires a positive integer argument")
+		return
+	}
+
+	line, err := strconv.ParseInt(ts[0].text, 10, 32)
+	if err != nil {
+		s.errorf("line number out of range: '%s'", ts[0].text)
+		return
+	}
+
+	file := s.file
+	if len(ts) > 1 {
+		if ts[1].kind != tokenKindString || !isStringLiteral(ts[1].text) {
+			s.errorf("invalid filename in #line directive: '%s'", ts[1].text)
+			return
+		}
+
+		file, err = strconv.Unquote(ts[1].text)
+		if err != nil {
+			file = ts[1].text[1 : len(ts[1].text)-1]
+		}
+	}
+
+	s.sync()
+	s.line = int(line) - 1
+	s.file = file
+
+	if s.p.lineMarkers {
+		s.replace(s.end, []byte(s.marker(int(line), "")))
+	}
+}
+
+// headerName macro-expands the operand of a computed #include and parses
+// the result as a "..." or <...> header name; path is "" if it is neither.
+func (s *state) headerName(value string) (path string, global bool) {
+	text := joinTokens(trimSpace(s.expandTokens(tokenize(value))))
+
+	switch {
+	case len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"':
+		return text[1 : len(text)-1], false
+	case len(text) >= 2 && text[0] == '<' && text[len(text)-1] == '>':
+		return text[1 : len(text)-1], true
+	}
+
+	return "", false
+}
+
+// push opens a conditional block at the current directive.
+func (s *state) push() {
+	s.p.push()
+	s.p.stack.kind = blockTypeConditional
+	s.p.stack.line, s.p.stack.column = s.location(s.pos)
+}
+
+// evaluator returns an evaluator for macro-expanded expressions.
+func (s *state) evaluator() *eval.Evaluator {
+	return &eval.Evaluator{
+		Defined: s.p.defined,
+		HasInclude: func(path string, global bool, next bool) bool {
+			if s.p.include == nil {
+				return false
+			}
+
+			from := -1
+			if next {
+				from = s.next()
+			}
+
+			_, _, _, err := s.p.include(path, global, s.id, from)
+			return err == nil
+		},
+		HasEmbed: s.hasEmbed,
+	}
+}
+
+// evaluate macro-expands an #if expression and evaluates it.
+func (s *state) evaluate(value string) bool {
+	ts := tokenize(value)
+
+	// the operand of defined is not macro-expanded
+	for i := 0; i < len(ts); i++ {
+		if ts[i].kind != tokenKindID || ts[i].text != "defined" {
+			continue
+		}
+
+		j := nextNonSpace(ts, i+1)
+		if j < len(ts) && ts[j].text == "(" {
+			j = nextNonSpace(ts, j+1)
+		}
+
+		if j < len(ts) && ts[j].kind == tokenKindID {
+			ts[j].hide = ts[j].hide.with(ts[j].text)
+			i = j
+		}
+	}
+
+	// nor is a <...> header name operand of __has_include or __has_embed
+	for i := 0; i < len(ts); i++ {
+		if ts[i].text != "__has_include" && ts[i].text != "__has_include_next" && ts[i].text != "__has_embed" {
+			continue
+		}
+
+		j := nextNonSpace(ts, i+1)
+		if j < len(ts) && ts[j].text == "(" {
+			j = nextNonSpace(ts, j+1)
+		}
+
+		if j >= len(ts) || ts[j].text != "<" {
+			continue
+		}
+
+		for ; j < len(ts) && ts[j].text != ">"; j++ {
+			if ts[j].kind == tokenKindID {
+				ts[j].hide = ts[j].hide.with(ts[j].text)
+			}
+		}
+		i = j
+	}
+
+	ts = s.expandTokens(ts)
+	for i, t := range ts {
+		if t.kind == tokenKindSpace {
+			ts[i].text = " "
+		}
+	}
+
+	result, err := s.evaluator().Evaluate(joinTokens(ts))
+	if err != nil {
+		s.errorf("%s", err)
+	}
+
+	return result
+}
+
 func (s *state) process() string {
 	bol := true
 
+	base := s.p.stack
+
 	clearFromTo := func(from, to int) {
-		s.s = append(s.s[:from], s.s[to:]...)
-		s.end = from
+		s.end = to
+		s.replace(from, nil)
 	}
 
 	for s.end < len(s.s) {
@@ -216,8 +691,15 @@ func (s *state) process() string {
 		case '\n':
 			bol = true
 			s.end += w
+
+			if s.newlines > 0 {
+				// keep the line count of arguments spanning multiple lines
+				s.replace(s.end, []byte(strings.Repeat("\n", s.newlines)))
+				s.newlines = 0
+			}
 		case '#':
 			start := s.end
+			s.pos = start
 			s.end += w
 			if s.end == len(s.s) {
 				break
@@ -232,9 +714,19 @@ func (s *state) process() string {
 			}
 
 			s.skipWhitespace()
+			at := s.end
 			directive := s.readID()
 			s.skipWhitespace()
 
+			// a GCC-style linemarker, e.g. # 42 "foo.h" 1, is read as #line
+			marker := directive != "" && isDigit(directive[0])
+			if marker {
+				s.end = at
+				directive = "line"
+			}
+
+			skipped := s.p.stack.skip
+
 			switch directive {
 			case "pragma":
 				if s.p.stack.skip {
@@ -243,13 +735,11 @@ func (s *state) process() string {
 					break
 				}
 
-				id := s.readID()
+				s.start = s.end
+				value := s.readToEOL()
+				clear()
 
-				switch id {
-				case "once":
-					s.once = true
-					clear()
-				}
+				s.replace(s.end, []byte(s.pragma(value)))
 
 			case "define":
 				if s.p.stack.skip {
@@ -258,49 +748,95 @@ func (s *state) process() string {
 					break
 				}
 
-				id := s.readID()
-
-				s.skipWhitespace()
-
 				s.start = s.end
 
+				var definition strings.Builder
+
 				for s.end < len(s.s) {
-					r, w := utf8.DecodeRune(s.s[s.end:])
-					if r == '\n' {
+					t, end := scanToken(s.s, s.end)
+					if t.kind == tokenKindNewline || strings.HasPrefix(t.text, "//") {
 						break
-					} else {
-						if r == '/' {
-							r, w2 := utf8.DecodeRune(s.s[s.end+w:])
-							if r == '/' {
-								break
-							}
+					}
 
-							s.end += w
+					if t.kind == tokenKindSpace && strings.Contains(t.text, "\n") {
+						// a comment spanning lines is a single space
+						s.newlines += strings.Count(t.text, "\n")
+						t.text = " "
+					}
 
-							if r == '*' {
-								s.end += w2
-								for s.end < len(s.s) {
-									r, w := utf8.DecodeRune(s.s[s.end:])
-									s.end += w
-
-									if r == '*' {
-										r, w := utf8.DecodeRune(s.s[s.end:])
-										s.end += w
-										if r == '/' {
-											break
-										}
-									}
-								}
-							}
-						} else {
-							s.end += w
+					definition.WriteString(t.text)
+					s.end = end
+				}
+
+				m, err := parseMacro(definition.String())
+				if err != nil {
+					s.errorf("%s", err)
+				} else {
+					if prev, ok := s.p.defines[m.name]; ok && !prev.equal(m) {
+						s.warningf("'%s' macro redefined", m.name)
+					}
+					s.p.defines[m.name] = m
+				}
+				clear()
+			case "error", "warning":
+				if s.p.stack.skip {
+					s.readToEOL()
+					clear()
+					break
+				}
+
+				s.start = s.end
+				message := strings.TrimSpace("#" + directive + " " + spelling(tokenize(s.readToEOL())))
+
+				if directive == "error" {
+					s.errorf("%s", message)
+				} else {
+					s.warningf("%s", message)
+				}
+
+				clear()
+			case "line":
+				if s.p.stack.skip {
+					s.readToEOL()
+					clear()
+					break
+				}
+
+				s.start = s.end
+				value := s.readToEOL()
+				clear()
+
+				if marker {
+					// drop the flags of a linemarker
+					ts := tokenize(value)
+					for i, t := range ts {
+						if t.kind == tokenKindString {
+							ts = ts[:i+1]
+							break
 						}
 					}
+					value = joinTokens(ts)
+				}
+
+				s.setLine(value)
+			case "embed":
+				if s.p.stack.skip {
+					s.readToEOL()
+					clear()
+					break
 				}
 
-				value := string(s.s[s.start:s.end])
-				s.p.defines[id] = value
+				s.start = s.end
+				value := s.readToEOL()
 				clear()
+
+				embedded, err := s.embed(value)
+				if err != nil {
+					s.errorf("%s", err)
+					break
+				}
+
+				s.replace(s.end, []byte(embedded))
 			case "undef":
 				if s.p.stack.skip {
 					s.readToEOL()
@@ -309,86 +845,137 @@ func (s *state) process() string {
 				}
 
 				id := s.readID()
+				if id == "" {
+					s.errorf("macro names must be identifiers")
+				}
 				delete(s.p.defines, id)
+				s.readToEOL()
 				clear()
 			case "if":
 				s.skipWhitespace()
 
-				s.p.push()
+				s.push()
+
+				skip := s.p.stack.skip
 
-				if !s.p.stack.skip {
-					value := s.readToEOL()
-					s.p.stack.value = eval.Evaluate(value, s.p.defines)
+				value := s.readToEOL()
+				if !skip {
+					s.p.stack.value = s.evaluate(value)
 				}
 
-				s.p.stack.skip = !s.p.stack.value
+				s.p.stack.skip = skip || !s.p.stack.value
 
 				clear()
 			case "ifdef":
-				s.p.push()
+				s.push()
+
+				skip := s.p.stack.skip
 
 				s.skipWhitespace()
 				value := s.readToEOL()
 
-				if !s.p.stack.skip {
+				if !skip {
 					l := eval.NewLexer([]byte(value))
 					t := l.Read()
 					switch t.Kind {
 					case eval.TokenKindID:
-						_, ok := s.p.defines[value[t.Start:t.End]]
+						ok := s.p.defined(value[t.Start:t.End])
 						s.p.stack.value = ok
+					default:
+						s.errorf("macro names must be identifiers")
 					}
 				}
 
-				s.p.stack.skip = !s.p.stack.value
+				s.p.stack.skip = skip || !s.p.stack.value
 
 				clear()
 			case "ifndef":
-				s.p.push()
+				s.push()
+
+				skip := s.p.stack.skip
 
 				s.skipWhitespace()
 				value := s.readToEOL()
 
-				if !s.p.stack.skip {
+				if !skip {
 					l := eval.NewLexer([]byte(value))
 					t := l.Read()
 					switch t.Kind {
 					case eval.TokenKindID:
-						_, ok := s.p.defines[value[t.Start:t.End]]
+						ok := s.p.defined(value[t.Start:t.End])
 						s.p.stack.value = !ok
+					default:
+						s.errorf("macro names must be identifiers")
 					}
 				}
 
-				s.p.stack.skip = !s.p.stack.value
+				s.p.stack.skip = skip || !s.p.stack.value
 
 				clear()
 			case "else":
+				if s.p.stack == base {
+					s.errorf("#else without #if")
+					s.readToEOL()
+					clear()
+					break
+				}
+
+				if s.p.stack.kind == blockTypeUnconditional {
+					s.errorf("#else after #else")
+				}
+
 				prev := s.p.pop()
 
 				s.p.push()
-				s.p.stack.value = !prev.value
-				s.p.stack.skip = !s.p.stack.value
+				s.p.stack.kind = blockTypeUnconditional
+
+				// value records whether any branch of the conditional was taken
+				skip := s.p.stack.skip
+				s.p.stack.value = true
+				s.p.stack.skip = skip || prev.value
+				s.readToEOL()
 				clear()
 			case "elif":
+				if s.p.stack == base {
+					s.errorf("#elif without #if")
+					s.readToEOL()
+					clear()
+					break
+				}
+
+				if s.p.stack.kind == blockTypeUnconditional {
+					s.errorf("#elif after #else")
+				}
+
 				prev := s.p.pop()
-				s.p.push()
+				s.push()
+
+				skip := s.p.stack.skip
 
 				s.skipWhitespace()
 				value := s.readToEOL()
 
-				if !s.p.stack.skip {
-					if !prev.value {
-						s.p.stack.value = eval.Evaluate(value, s.p.defines)
-					}
+				taken := false
+				if !skip && !prev.value {
+					taken = s.evaluate(value)
 				}
 
-				s.p.stack.skip = !s.p.stack.value
+				s.p.stack.value = prev.value || taken
+				s.p.stack.skip = skip || !taken
 
 				clear()
 			case "endif":
+				if s.p.stack == base {
+					s.errorf("#endif without #if")
+					s.readToEOL()
+					clear()
+					break
+				}
+
 				s.p.pop()
+				s.readToEOL()
 				clear()
-			case "include":
+			case "include", "include_next":
 				if s.p.stack.skip {
 					s.readToEOL()
 					clear()
@@ -431,35 +1018,122 @@ func (s *state) process() string {
 
 						s.end += w
 					}
+				} else {
+					// a computed include, e.g. #include HEADER
+					s.end -= w
+					s.start = s.end
+					path, global = s.headerName(s.readToEOL())
+				}
+
+				// drop the rest of the line, e.g. a comment
+				s.readToEOL()
+
+				if path == "" {
+					s.errorf("#include expects \"FILENAME\" or <FILENAME>")
+					clear()
+					break
+				}
+
+				from := -1
+				if directive == "include_next" {
+					if s.parent == nil {
+						s.warningf("#include_next in primary source file")
+					}
+
+					from = s.next()
 				}
 
-				id, bs, err := s.p.include(path, global)
+				key := includeKey{path: path, global: global, includer: s.id, from: from}
+				if id, ok := s.p.resolved[key]; ok && s.p.guarded(id) {
+					clear()
+					break
+				}
+
+				id, index, bs, err := s.p.include(path, global, s.id, from)
 				if err != nil {
+					s.errorf("%s", err)
 					clear()
 					break
 				}
 
-				source := strings.ReplaceAll(string(bs), "\r\n", "\n")
+				s.p.resolved[key] = id
 
-				is := &state{
-					p: s.p,
-					s: []byte(source),
+				if s.p.guarded(id) {
+					clear()
+					break
 				}
 
-				processed := is.process()
+				chain := s.includeChain()
+
+				cycle := false
+				for _, includer := range chain {
+					if includer == id {
+						cycle = true
+					}
+				}
+
+				if cycle || s.depth+1 > s.p.maxIncludeDepth {
+					chain = append(chain, id)
+
+					if cycle {
+						s.errorf("#include cycle: %s", strings.Join(chain, " -> "))
+					} else {
+						s.errorf("#include nested depth exceeds maximum of %d: %s", s.p.maxIncludeDepth, strings.Join(chain, " -> "))
+					}
 
-				if is.once && s.p.includes[id] {
 					clear()
 					break
 				}
 
-				s.p.includes[id] = true
+				is := &state{
+					p: s.p,
+					s: normalize(string(bs)),
+
+					id:     id,
+					file:   id,
+					line:   1,
+					depth:  s.depth + 1,
+					parent: s,
+					index:  index,
+				}
+
+				if _, ok := s.p.guards[id]; !ok {
+					if guard := detectGuard(is.s); guard != "" {
+						s.p.guards[id] = guard
+					}
+				}
+
+				processed := is.process()
+
+				if s.p.lineMarkers {
+					line, _ := s.location(s.end)
+
+					processed = is.marker(1, "1") + "\n" + processed
+					if !strings.HasSuffix(processed, "\n") {
+						processed += "\n"
+					}
+					processed += s.marker(line+1, "2")
+				}
 
-				s.s = append(s.s[:start], append([]byte(processed), s.s[s.end:]...)...)
-				s.end = start + len(processed)
+				s.replace(start, []byte(processed))
 			default:
-				// not a preprocessor directive
-				continue
+				handler, ok := s.p.directives[directive]
+				if !ok {
+					// not a preprocessor directive
+					continue
+				}
+
+				s.start = s.end
+				value := s.readToEOL()
+				clear()
+
+				s.directive(directive, handler, value, s.p.stack.skip)
+			}
+
+			if skipped && !s.p.stack.skip && s.p.lineMarkers {
+				// skipped blocks do not keep their lines
+				line, _ := s.location(s.end)
+				s.replace(s.end, []byte(s.marker(line+1, "")))
 			}
 		case '/':
 			start := s.end
@@ -511,40 +1185,60 @@ func (s *state) process() string {
 			}
 		default:
 			if s.p.stack.skip {
-				s.start = s.end
-				s.readToEOL()
-				clearFromTo(s.start, s.end)
+				start := s.end
+				if r == ' ' || r == '\t' {
+					// the line may hold an indented directive
+					s.skipWhitespace()
+				} else {
+					s.start = start
+					s.readLine()
+				}
+				clearFromTo(start, s.end)
 			} else {
-				s.start = s.end
-				s.end += w
+				start := s.end
+				s.pos = start
 
-				visited := map[string]bool{}
-				for {
-					if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' {
-						id := s.readID()
+				t, end := scanToken(s.s, s.end)
+				s.end = end
 
-						v, ok := s.p.defines[id]
+				if t.kind != tokenKindID {
+					break
+				}
 
-						if ok {
-							if visited[id] {
-								break
-							}
+				if _, ok := s.p.defines[t.text]; !ok && t.text != "_Pragma" {
+					break
+				}
 
-							s.s = append(s.s[:s.start], append([]byte(v), s.s[s.end:]...)...)
-							s.end = s.start
+				e := &expander{
+					s:      s,
+					source: true,
+					ts:     []token{t},
+				}
 
-							visited[id] = true
+				expanded := joinTokens(e.expand())
 
-							r, _ = utf8.DecodeRune(s.s[s.end:])
-							continue
-						}
+				if !s.p.lineMarkers {
+					// a _Pragma on a line of its own needs no newlines around
+					// it; elsewhere it adds lines to the output
+					if start == 0 || s.s[start-1] == '\n' {
+						expanded = strings.TrimPrefix(expanded, "\n")
+					}
+					if s.end == len(s.s) || s.s[s.end] == '\n' {
+						expanded = strings.TrimSuffix(expanded, "\n")
 					}
-					break
 				}
+
+				s.replace(start, []byte(expanded))
+				s.newlines += e.newlines
 			}
 		}
 	}
 
+	for s.p.stack != base {
+		s.reportAt(s.p.stack.line, s.p.stack.column, SeverityError, "unterminated conditional directive")
+		s.p.pop()
+	}
+
 	result := string(s.s)
 	return result
 }
@@ -1,24 +1,37 @@
 package cpre
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
-func testIncluder(filePath string, global bool) (string, []byte, error) {
+func testIncluder(filePath string, global bool, includer string, from int) (string, int, []byte, error) {
 	p := filepath.Join("examples", filePath)
 
 	id, err := filepath.Abs(p)
 	if err != nil {
-		return "", nil, err
+		return "", -1, nil, err
 	}
 
 	source, err := os.ReadFile(p)
 
-	return id, source, err
+	return id, -1, source, err
+}
+
+// testRelativeIncluder is like testIncluder, but uses the include path as
+// the id, so that file names in the output do not depend on the location of
+// the repository.
+func testRelativeIncluder(filePath string, global bool, includer string, from int) (string, int, []byte, error) {
+	source, err := os.ReadFile(filepath.Join("examples", filePath))
+	return filePath, -1, source, err
 }
 
 func testPreprocess(t *testing.T, name string) {
@@ -40,6 +53,46 @@ func testPreprocessWithPreprocessor(t *testing.T, name string, p *Preprocessor)
 	assert.Equal(t, string(expected), actual)
 }
 
+// testProcessFile is like testPreprocessWithPreprocessor, but processes the
+// example as a named file.
+func testProcessFile(t *testing.T, name string, p *Preprocessor) {
+	source, err := os.ReadFile("examples/" + name + ".cpp")
+	assert.NoError(t, err)
+	expected, err := os.ReadFile("examples/" + name + ".pre.cpp")
+	assert.NoError(t, err)
+
+	actual, _, err := p.ProcessFile(name+".cpp", string(source))
+	assert.NoError(t, err)
+
+	assert.Equal(t, string(expected), actual)
+}
+
+func testDiagnostics(t *testing.T, name string, expected []Diagnostic) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: testIncluder,
+	})
+
+	source, err := os.ReadFile("examples/" + name + ".cpp")
+	assert.NoError(t, err)
+
+	_, actual, err := p.ProcessFile(name+".cpp", string(source))
+
+	failed := false
+	for _, d := range expected {
+		if d.Severity == SeverityError {
+			failed = true
+		}
+	}
+
+	if failed {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
 func TestSingleLineComment(t *testing.T) {
 	testPreprocess(t, "single_line_comment")
 }
@@ -79,3 +132,442 @@ func TestNotOnce(t *testing.T) {
 func TestIfndef(t *testing.T) {
 	testPreprocess(t, "ifndef")
 }
+
+func TestFunctionMacro(t *testing.T) {
+	testPreprocess(t, "function_macro")
+}
+
+func TestVariadicMacro(t *testing.T) {
+	testPreprocess(t, "variadic_macro")
+}
+
+func TestStringizePaste(t *testing.T) {
+	testPreprocess(t, "stringize_paste")
+}
+
+func TestElse(t *testing.T) {
+	testPreprocess(t, "else")
+	testDiagnostics(t, "else", nil)
+}
+
+func TestDiagnostics(t *testing.T) {
+	testDiagnostics(t, "diagnostics", []Diagnostic{
+		{File: "diagnostics.cpp", Line: 1, Column: 1, Severity: SeverityError, Message: "open examples/missing.h: no such file or directory"},
+		{File: "diagnostics.cpp", Line: 3, Column: 9, Severity: SeverityError, Message: "macro 'F' requires 1 arguments, but 2 given"},
+		{File: "diagnostics.cpp", Line: 4, Column: 1, Severity: SeverityError, Message: "missing expression"},
+		{File: "diagnostics.cpp", Line: 7, Column: 9, Severity: SeverityError, Message: "pasting '+' and '-' does not give a valid preprocessing token"},
+		{File: "diagnostics.cpp", Line: 9, Column: 1, Severity: SeverityWarning, Message: "'X' macro redefined"},
+		{File: "diagnostics.cpp", Line: 10, Column: 1, Severity: SeverityError, Message: "#endif without #if"},
+		{File: "diagnostics.cpp", Line: 14, Column: 1, Severity: SeverityError, Message: "macro names must be identifiers"},
+		{File: "diagnostics.cpp", Line: 11, Column: 1, Severity: SeverityError, Message: "unterminated conditional directive"},
+	})
+}
+
+func TestExpressions(t *testing.T) {
+	testPreprocess(t, "expressions")
+}
+
+func TestDefined(t *testing.T) {
+	testPreprocess(t, "defined")
+}
+
+func TestContinuation(t *testing.T) {
+	testPreprocess(t, "continuation")
+}
+
+func TestLiterals(t *testing.T) {
+	testPreprocess(t, "literals")
+}
+
+func TestErrorWarning(t *testing.T) {
+	testPreprocess(t, "error_warning")
+
+	testDiagnostics(t, "error_warning", []Diagnostic{
+		{File: "error_warning.cpp", Line: 5, Column: 1, Severity: SeverityWarning, Message: "#warning \"deprecated header\""},
+		{File: "error_warning.cpp", Line: 7, Column: 1, Severity: SeverityError, Message: "#error \"unsupported platform\""},
+		{File: "error_warning.cpp", Line: 9, Column: 1, Severity: SeverityError, Message: "#error"},
+	})
+}
+
+func TestLine(t *testing.T) {
+	testPreprocess(t, "line")
+
+	testDiagnostics(t, "line", []Diagnostic{
+		{File: "gnu.c", Line: 8, Column: 1, Severity: SeverityWarning, Message: "#warning \"here\""},
+		{File: "gnu.c", Line: 9, Column: 1, Severity: SeverityError, Message: "invalid filename in #line directive: '\"'"},
+	})
+}
+
+func TestLineMarkers(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include:     testRelativeIncluder,
+		LineMarkers: true,
+	})
+
+	testProcessFile(t, "linemarkers", p)
+}
+
+func TestBuiltins(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: testRelativeIncluder,
+		Now: func() time.Time {
+			return time.Date(2024, time.March, 5, 7, 8, 9, 0, time.UTC)
+		},
+	})
+
+	testProcessFile(t, "builtin", p)
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1709622489")
+
+	p := NewPreprocessor(PreprocessorConfig{})
+
+	actual, _, err := p.ProcessFile("", "__DATE__ __TIME__")
+	assert.NoError(t, err)
+	assert.Equal(t, `"Mar  5 2024" "07:08:09"`, actual)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "invalid")
+
+	actual, _, err = p.ProcessFile("", "__DATE__")
+	assert.Error(t, err)
+	assert.Equal(t, `"??? ?? ????"`, actual)
+}
+
+func TestDefineFunc(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{})
+
+	assert.NoError(t, p.DefineFunc("GIT_SHA", func(ctx MacroContext, args []string) (string, error) {
+		return `"0123abc"`, nil
+	}))
+	assert.NoError(t, p.DefineFunc("WHERE", func(ctx MacroContext, args []string) (string, error) {
+		return fmt.Sprintf(`"%s:%d %s"`, ctx.File, ctx.Line, ctx.Name), nil
+	}))
+	assert.NoError(t, p.DefineFunc("SUM(a, b, c)", func(ctx MacroContext, args []string) (string, error) {
+		return "(" + strings.Join(args, ") + (") + ")", nil
+	}))
+	assert.NoError(t, p.DefineFunc("JOIN(...)", func(ctx MacroContext, args []string) (string, error) {
+		return `"` + strings.Join(args, "|") + `" ` + args[len(args)-1], nil
+	}))
+	assert.NoError(t, p.DefineFunc("FAIL(x)", func(ctx MacroContext, args []string) (string, error) {
+		return "", errors.New("failed on purpose")
+	}))
+
+	assert.Error(t, p.DefineFunc("1", nil))
+	assert.Error(t, p.DefineFunc("X 1", nil))
+
+	testPreprocessWithPreprocessor(t, "define_func", p)
+
+	_, diagnostics, err := p.ProcessFile("define_func.cpp", "int error = FAIL(1);")
+	assert.Error(t, err)
+	assert.Equal(t, []Diagnostic{
+		{File: "define_func.cpp", Line: 1, Column: 13, Severity: SeverityError, Message: "failed to expand macro: 'FAIL': failed on purpose"},
+	}, diagnostics)
+}
+
+func TestDirective(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{})
+
+	var features []string
+
+	assert.NoError(t, p.RegisterDirective("feature", func(ctx *DirectiveContext) (string, error) {
+		if ctx.Skipping {
+			return "skipped", nil
+		}
+
+		if ctx.Value == "" {
+			return "", errors.New("missing feature name")
+		}
+
+		features = append(features, ctx.Value)
+
+		return "#define FEATURE_" + strings.ToUpper(ctx.Value) + " 1", nil
+	}))
+	assert.NoError(t, p.RegisterDirective("import_shader", func(ctx *DirectiveContext) (string, error) {
+		ctx.Warningf("importing '%s' at %s:%d:%d", ctx.Value, ctx.File, ctx.Line, ctx.Column)
+		return "vec4 " + ctx.Value + "();", nil
+	}))
+
+	assert.Error(t, p.RegisterDirective("define", nil))
+	assert.Error(t, p.RegisterDirective("not valid", nil))
+
+	source, err := os.ReadFile("examples/directive.cpp")
+	assert.NoError(t, err)
+	expected, err := os.ReadFile("examples/directive.pre.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err := p.ProcessFile("directive.cpp", string(source))
+	assert.Error(t, err)
+
+	assert.Equal(t, string(expected), actual)
+	assert.Equal(t, []string{"fast_math"}, features)
+	assert.Equal(t, []Diagnostic{
+		{File: "directive.cpp", Line: 6, Column: 1, Severity: SeverityWarning, Message: "importing 'common' at directive.cpp:6:1"},
+		{File: "directive.cpp", Line: 8, Column: 1, Severity: SeverityError, Message: "#feature failed: missing feature name"},
+	}, diagnostics)
+}
+
+func TestPragma(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{})
+
+	assert.NoError(t, p.RegisterPragma("message", func(ctx *PragmaContext) (string, error) {
+		ctx.Warningf("%s", ctx.Value)
+		return "", nil
+	}))
+	assert.NoError(t, p.RegisterPragma("region", func(ctx *PragmaContext) (string, error) {
+		return "// " + ctx.Text, nil
+	}))
+
+	assert.Error(t, p.RegisterPragma("once", nil))
+	assert.Error(t, p.RegisterPragma("", nil))
+
+	source, err := os.ReadFile("examples/pragma.cpp")
+	assert.NoError(t, err)
+	expected, err := os.ReadFile("examples/pragma.pre.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err := p.ProcessFile("pragma.cpp", string(source))
+	assert.Error(t, err)
+
+	assert.Equal(t, string(expected), actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "pragma.cpp", Line: 4, Column: 1, Severity: SeverityWarning, Message: "(\"building \" N)"},
+		{File: "pragma.cpp", Line: 9, Column: 1, Severity: SeverityWarning, Message: "(\"from _Pragma\")"},
+		{File: "pragma.cpp", Line: 13, Column: 1, Severity: SeverityError, Message: "_Pragma takes a parenthesized string literal"},
+		{File: "pragma.cpp", Line: 14, Column: 1, Severity: SeverityError, Message: "_Pragma takes a parenthesized string literal"},
+		{File: "pragma.cpp", Line: 16, Column: 1, Severity: SeverityError, Message: "_Pragma takes a parenthesized string literal"},
+	}, diagnostics)
+}
+
+func TestPushMacro(t *testing.T) {
+	testPreprocess(t, "push_macro")
+
+	testDiagnostics(t, "push_macro", []Diagnostic{
+		{File: "push_macro.cpp", Line: 11, Column: 1, Severity: SeverityWarning, Message: "macro 'min' was not pushed"},
+		{File: "push_macro.cpp", Line: 12, Column: 1, Severity: SeverityWarning, Message: "invalid #pragma push_macro directive"},
+	})
+
+	p := NewPreprocessor(PreprocessorConfig{})
+	assert.NoError(t, p.Define("X", "1"))
+
+	p.PushMacro("X")
+	assert.NoError(t, p.Define("X", "2"))
+	assert.Equal(t, "2", p.Process("X"))
+
+	assert.NoError(t, p.PopMacro("X"))
+	assert.Equal(t, "1", p.Process("X"))
+
+	assert.Error(t, p.PopMacro("X"))
+}
+
+func TestGuard(t *testing.T) {
+	reads := map[string]int{}
+
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: func(filePath string, global bool, includer string, from int) (string, int, []byte, error) {
+			reads[filePath]++
+			return testRelativeIncluder(filePath, global, includer, from)
+		},
+	})
+
+	testProcessFile(t, "guard", p)
+
+	_, diagnostics, err := p.ProcessFile("guard.cpp", "#include \"once_warning.h\"\n")
+	assert.NoError(t, err)
+	assert.Empty(t, diagnostics)
+
+	assert.Equal(t, map[string]string{"guarded.h": "GUARDED_H"}, p.guards)
+
+	// guarded files are skipped without being read again, unless the guard
+	// was undefined
+	assert.Equal(t, map[string]int{"once_warning.h": 1, "guarded.h": 2}, reads)
+}
+
+func TestDetectGuard(t *testing.T) {
+	tests := []struct {
+		source string
+		guard  string
+	}{
+		{"#ifndef X\n#define X\nint x;\n#endif\n", "X"},
+		{"// comment\n/* block\n */\n  #  ifndef X // comment\n#endif /* X */\n\n", "X"},
+		{"#if !defined(X)\n#endif", "X"},
+		{"#if !defined X\n#endif", "X"},
+		{"#ifndef X\n#ifdef Y\n#else\n#endif\n#endif\n", "X"},
+		{"int x;\n#ifndef X\n#endif\n", ""},
+		{"#ifndef X\n#endif\nint x;\n", ""},
+		{"#ifndef X\n#else\n#endif\n", ""},
+		{"#ifndef X\n#elif Y\n#endif\n", ""},
+		{"#ifndef X\n#endif\n#ifndef Y\n#endif\n", ""},
+		{"#ifndef X\n", ""},
+		{"#ifdef X\n#endif\n", ""},
+		{"#pragma once\n#ifndef X\n#endif\n", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.guard, detectGuard(normalize(test.source)), test.source)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: testRelativeIncluder,
+	})
+
+	source, err := os.ReadFile("examples/cycle.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err := p.ProcessFile("cycle.cpp", string(source))
+	assert.Error(t, err)
+	assert.Equal(t, "int a;\nint b;\n\n\n\nint main;\n", actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "cycle_b.h", Line: 2, Column: 1, Severity: SeverityError, Message: "#include cycle: cycle.cpp -> cycle_a.h -> cycle_b.h -> cycle_a.h"},
+	}, diagnostics)
+
+	p = NewPreprocessor(PreprocessorConfig{
+		Include:         testRelativeIncluder,
+		MaxIncludeDepth: 1,
+	})
+
+	_, diagnostics, err = p.ProcessFile("cycle.cpp", string(source))
+	assert.Error(t, err)
+	assert.Equal(t, []Diagnostic{
+		{File: "cycle_a.h", Line: 2, Column: 1, Severity: SeverityError, Message: "#include nested depth exceeds maximum of 1: cycle.cpp -> cycle_a.h -> cycle_b.h"},
+	}, diagnostics)
+}
+
+func TestIncluderConfig(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: NewIncluderWithConfig(IncluderConfig{
+			Quote:  []string{"examples/include/quote"},
+			System: []string{"examples/include/system"},
+			After:  []string{"examples/include/after"},
+		}),
+	})
+
+	source, err := os.ReadFile("examples/include/main.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err := p.ProcessFile("examples/include/main.cpp", string(source))
+	assert.Error(t, err)
+	assert.Equal(t, "int sub_b;\n\nint system_b;\n\n\nint quote_q;\n\n\nint system_c;\n\nint after_d;\n\n", actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "examples/include/main.cpp", Line: 3, Column: 1, Severity: SeverityError, Message: "failed to find #include file: 'q.h'"},
+	}, diagnostics)
+}
+
+func TestFSIncluder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/common.h":      {Data: []byte("#include \"detail/math.h\"\nint common;\n")},
+		"lib/detail/math.h": {Data: []byte("int math;\n")},
+		"shaders/light.h":   {Data: []byte("int light;\n")},
+	}
+
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: NewFSIncluder(fsys, []string{"lib"}),
+	})
+
+	actual, diagnostics, err := p.ProcessFile("shaders/main.glsl", "#include <common.h>\n#include \"light.h\"\n#include <light.h>\n#include \"../lib/common.h\"\n")
+	assert.Error(t, err)
+	assert.Equal(t, "int math;\n\nint common;\n\nint light;\n\n\nint math;\n\nint common;\n\n", actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "shaders/main.glsl", Line: 3, Column: 1, Severity: SeverityError, Message: "failed to find #include file: 'light.h'"},
+	}, diagnostics)
+}
+
+func TestOverlayIncluder(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: NewIncluderWithConfig(IncluderConfig{
+			Paths: []string{"examples"},
+			Overlay: map[string][]byte{
+				"examples/not_once.h":        []byte("const int unsaved = 2;"),
+				"examples/unsaved.h":         []byte("#include \"sibling.h\"\nconst int created = 3;"),
+				"examples/sibling.h":         []byte("const int sibling = 4;"),
+				"examples/shadow/not_once.h": []byte("const int shadowed = 5;"),
+			},
+		}),
+	})
+
+	assert.Equal(t, "const int unsaved = 2;\n\nconst int v = 1;\n", p.Process("#include \"not_once.h\"\n#include \"once.h\"\n"))
+
+	actual, diagnostics, err := p.ProcessFile("main.cpp", "#if __has_include(\"unsaved.h\")\n#include <unsaved.h>\n#endif\n#include \"missing.h\"\n")
+	assert.Error(t, err)
+	assert.Equal(t, "\nconst int sibling = 4;\nconst int created = 3;\n\n\n", actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "main.cpp", Line: 4, Column: 1, Severity: SeverityError, Message: "failed to find #include file: 'missing.h'"},
+	}, diagnostics)
+
+	// an unsaved file next to the includer shadows one found later on disk
+	actual, _, err = p.ProcessFile("examples/shadow/main.cpp", "#include \"not_once.h\"\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "const int shadowed = 5;\n", actual)
+
+	p = NewPreprocessor(PreprocessorConfig{
+		Include: NewFSIncluderWithConfig(fstest.MapFS{"lib/a.h": {Data: []byte("int a;")}}, IncluderConfig{
+			Paths: []string{"lib"},
+			Overlay: map[string][]byte{
+				"./lib/new.h": []byte("#include \"a.h\"\nint created;"),
+			},
+		}),
+	})
+
+	actual, _, err = p.ProcessFile("main.cpp", "#if __has_include(<new.h>)\n#include <new.h>\n#endif\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "\nint a;\nint created;\n\n", actual)
+}
+
+func TestComputedInclude(t *testing.T) {
+	testPreprocess(t, "computed_include")
+
+	testDiagnostics(t, "computed_include", []Diagnostic{
+		{File: "computed_include.cpp", Line: 9, Column: 1, Severity: SeverityError, Message: "#include expects \"FILENAME\" or <FILENAME>"},
+		{File: "computed_include.cpp", Line: 10, Column: 1, Severity: SeverityError, Message: "#include expects \"FILENAME\" or <FILENAME>"},
+	})
+}
+
+func TestHasInclude(t *testing.T) {
+	testPreprocess(t, "has_include")
+}
+
+func TestIncludeNext(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{
+		Include: NewIncluder([]string{"examples/include_next/wrap", "examples/include_next/sys"}),
+	})
+
+	source, err := os.ReadFile("examples/include_next/main.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err := p.ProcessFile("main.cpp", string(source))
+	assert.NoError(t, err)
+	assert.Equal(t, "\nint sys;\n\n\nint wrap;\n\n\nint only;\n\n\n\nint sys;\n\n\nint wrap;\n\n", actual)
+	assert.Equal(t, []Diagnostic{
+		{File: "main.cpp", Line: 3, Column: 1, Severity: SeverityWarning, Message: "#include_next in primary source file"},
+	}, diagnostics)
+
+	// x.h is found in the includer's directory, so #include_next continues
+	// with the first search path
+	p = NewPreprocessor(PreprocessorConfig{
+		Include: NewIncluder([]string{"examples/include_next/sys"}),
+	})
+
+	source, err = os.ReadFile("examples/include_next/local/main.cpp")
+	assert.NoError(t, err)
+
+	actual, diagnostics, err = p.ProcessFile("examples/include_next/local/main.cpp", string(source))
+	assert.NoError(t, err)
+	assert.Equal(t, "int sys_x;\n\nint local;\n\n", actual)
+	assert.Empty(t, diagnostics)
+}
+
+func TestEmbed(t *testing.T) {
+	testPreprocess(t, "embed")
+
+	testDiagnostics(t, "embed", []Diagnostic{
+		{File: "embed.cpp", Line: 21, Column: 1, Severity: SeverityError, Message: "open examples/missing.bin: no such file or directory"},
+		{File: "embed.cpp", Line: 22, Column: 1, Severity: SeverityError, Message: "negative #embed limit: -1"},
+		{File: "embed.cpp", Line: 23, Column: 1, Severity: SeverityError, Message: "duplicate #embed parameter: 'limit'"},
+		{File: "embed.cpp", Line: 24, Column: 1, Severity: SeverityError, Message: "unsupported #embed parameter: 'unknown'"},
+		{File: "embed.cpp", Line: 25, Column: 1, Severity: SeverityError, Message: "#embed expects \"FILENAME\" or <FILENAME>"},
+		{File: "embed.cpp", Line: 26, Column: 1, Severity: SeverityError, Message: "#embed expects \"FILENAME\" or <FILENAME>"},
+	})
+}
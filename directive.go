@@ -0,0 +1,112 @@
+package cpre
+
+import (
+	"github.com/pkg/errors"
+)
+
+// builtinDirectives lists the directives handled by the preprocessor itself,
+// which cannot be registered.
+var builtinDirectives = map[string]bool{
+	"define":       true,
+	"elif":         true,
+	"else":         true,
+	"embed":        true,
+	"endif":        true,
+	"error":        true,
+	"if":           true,
+	"ifdef":        true,
+	"ifndef":       true,
+	"include":      true,
+	"include_next": true,
+	"line":         true,
+	"pragma":       true,
+	"undef":        true,
+	"warning":      true,
+}
+
+// DirectiveContext describes an invocation of a custom directive.
+type DirectiveContext struct {
+	Name string
+	// Value is the rest of the line following the directive name, with
+	// comments and surrounding whitespace removed.
+	Value string
+
+	File   string
+	Line   int
+	Column int
+
+	// Skipping is set if the directive is in a skipped conditional block;
+	// text returned by the handler is then discarded.
+	Skipping bool
+
+	s *state
+}
+
+func (c *DirectiveContext) Errorf(format string, args ...interface{}) {
+	c.s.reportAt(c.Line, c.Column, SeverityError, format, args...)
+}
+
+func (c *DirectiveContext) Warningf(format string, args ...interface{}) {
+	c.s.reportAt(c.Line, c.Column, SeverityWarning, format, args...)
+}
+
+// DirectiveHandler handles a custom directive; the returned text is
+// preprocessed like included source and replaces the directive in the
+// output, and an error is reported as a diagnostic.
+type DirectiveHandler func(ctx *DirectiveContext) (string, error)
+
+// RegisterDirective registers a handler for a custom directive, e.g.
+// "feature" for #feature X.
+func (p *Preprocessor) RegisterDirective(name string, handler DirectiveHandler) error {
+	if ts := tokenize(name); len(ts) != 1 || ts[0].kind != tokenKindID {
+		return errors.Errorf("invalid directive name: '%s'", name)
+	}
+
+	if builtinDirectives[name] {
+		return errors.Errorf("cannot register builtin directive: '%s'", name)
+	}
+
+	p.directives[name] = handler
+
+	return nil
+}
+
+// directive runs the handler of a custom directive whose line has already
+// been cleared.
+func (s *state) directive(name string, handler DirectiveHandler, value string, skipping bool) {
+	line, column := s.location(s.pos)
+
+	ctx := &DirectiveContext{
+		Name:     name,
+		Value:    spelling(tokenize(value)),
+		File:     s.file,
+		Line:     line,
+		Column:   column,
+		Skipping: skipping,
+		s:        s,
+	}
+
+	text, err := handler(ctx)
+	if err != nil {
+		ctx.Errorf("%s", errors.Wrapf(err, "#%s failed", name))
+		return
+	}
+
+	if text == "" || skipping {
+		return
+	}
+
+	ts := &state{
+		p: s.p,
+		s: normalize(text),
+
+		id:     s.id,
+		file:   s.file,
+		line:   line,
+		depth:  s.depth,
+		parent: s.parent,
+		index:  s.index,
+	}
+
+	s.replace(s.end, []byte(ts.process()))
+}
@@ -0,0 +1,224 @@
+package cpre
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the results of __has_embed, as defined by __STDC_EMBED_NOT_FOUND__,
+// __STDC_EMBED_FOUND__ and __STDC_EMBED_EMPTY__
+const (
+	embedNotFound = iota
+	embedFound
+	embedEmpty
+)
+
+// embedParams holds the parameters of #embed; limit is -1 if not given.
+type embedParams struct {
+	limit   int64
+	prefix  []token
+	suffix  []token
+	ifEmpty []token
+}
+
+// headerNameTokens splits a "..." or <...> header name off the start of ts.
+func headerNameTokens(ts []token) (path string, global bool, rest []token, ok bool) {
+	i := nextNonSpace(ts, 0)
+	if i >= len(ts) {
+		return "", false, nil, false
+	}
+
+	if ts[i].kind == tokenKindString && isStringLiteral(ts[i].text) {
+		return ts[i].text[1 : len(ts[i].text)-1], false, ts[i+1:], true
+	}
+
+	if ts[i].text != "<" {
+		return "", false, nil, false
+	}
+
+	var sb strings.Builder
+	for j := i + 1; j < len(ts); j++ {
+		if ts[j].text == ">" {
+			return sb.String(), true, ts[j+1:], true
+		}
+
+		sb.WriteString(ts[j].text)
+	}
+
+	return "", false, nil, false
+}
+
+// embedParams parses the macro-expanded parameters of #embed or __has_embed;
+// unsupported is the name of the first parameter that is not supported.
+func (s *state) embedParams(ts []token) (params embedParams, unsupported string, err error) {
+	params.limit = -1
+
+	seen := map[string]bool{}
+
+	for i := nextNonSpace(ts, 0); i < len(ts); i = nextNonSpace(ts, i) {
+		if ts[i].kind != tokenKindID {
+			return params, "", errors.Errorf("invalid #embed parameter: '%s'", ts[i].text)
+		}
+
+		name := ts[i].text
+		if len(name) > 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__") {
+			name = name[2 : len(name)-2]
+		}
+
+		i = nextNonSpace(ts, i+1)
+		if i < len(ts) && ts[i].text == "::" {
+			// a vendor parameter, e.g. gnu::offset
+			return params, name + "::", nil
+		}
+
+		if i >= len(ts) || ts[i].text != "(" {
+			return params, "", errors.Errorf("#embed parameter '%s' requires a parenthesized argument", name)
+		}
+
+		start := i + 1
+
+		depth := 0
+		for ; i < len(ts); i++ {
+			if ts[i].text == "(" {
+				depth++
+			} else if ts[i].text == ")" {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+
+		if i >= len(ts) {
+			return params, "", errors.Errorf("missing ')' after #embed parameter '%s'", name)
+		}
+
+		arg := trimSpace(ts[start:i])
+		i++
+
+		if seen[name] {
+			return params, "", errors.Errorf("duplicate #embed parameter: '%s'", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "limit":
+			v, err := s.evaluator().EvaluateValue(joinTokens(arg))
+			if err != nil {
+				return params, "", errors.Wrap(err, "invalid #embed limit")
+			}
+
+			if !v.Unsigned && v.Int < 0 {
+				return params, "", errors.Errorf("negative #embed limit: %s", v)
+			}
+
+			params.limit = v.Int
+		case "prefix":
+			params.prefix = arg
+		case "suffix":
+			params.suffix = arg
+		case "if_empty":
+			params.ifEmpty = arg
+		default:
+			return params, name, nil
+		}
+	}
+
+	return params, "", nil
+}
+
+// readEmbed reads the contents of an embedded resource up to the limit.
+func (s *state) readEmbed(path string, global bool, limit int64) ([]byte, error) {
+	if s.p.include == nil {
+		return nil, errors.Errorf("failed to find #embed file: '%s'", path)
+	}
+
+	_, _, bs, err := s.p.include(path, global, s.id, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit >= 0 && int64(len(bs)) > limit {
+		bs = bs[:limit]
+	}
+
+	return bs, nil
+}
+
+// embed implements #embed, returning the bytes of the resource as a
+// comma-separated list of integers.
+func (s *state) embed(value string) (string, error) {
+	ts := tokenize(value)
+
+	path, global, rest, ok := headerNameTokens(ts)
+	if ok {
+		rest = s.expandTokens(rest)
+	} else {
+		// a computed resource name, e.g. #embed RESOURCE
+		path, global, rest, ok = headerNameTokens(s.expandTokens(ts))
+	}
+
+	if !ok {
+		return "", errors.New("#embed expects \"FILENAME\" or <FILENAME>")
+	}
+
+	params, unsupported, err := s.embedParams(rest)
+	if err != nil {
+		return "", err
+	}
+
+	if unsupported != "" {
+		return "", errors.Errorf("unsupported #embed parameter: '%s'", unsupported)
+	}
+
+	bs, err := s.readEmbed(path, global, params.limit)
+	if err != nil {
+		return "", err
+	}
+
+	if len(bs) == 0 {
+		return joinTokens(params.ifEmpty), nil
+	}
+
+	values := make([]string, len(bs))
+	for i, b := range bs {
+		values[i] = strconv.Itoa(int(b))
+	}
+
+	result := strings.Join(values, ",")
+
+	if len(params.prefix) > 0 {
+		result = joinTokens(params.prefix) + result
+	}
+
+	if len(params.suffix) > 0 {
+		result += joinTokens(params.suffix)
+	}
+
+	return result, nil
+}
+
+// hasEmbed implements the __has_embed operator.
+func (s *state) hasEmbed(path string, global bool, value string) (int, error) {
+	params, unsupported, err := s.embedParams(tokenize(value))
+	if err != nil {
+		return 0, err
+	}
+
+	if unsupported != "" {
+		return embedNotFound, nil
+	}
+
+	bs, err := s.readEmbed(path, global, params.limit)
+	if err != nil {
+		return embedNotFound, nil
+	}
+
+	if len(bs) == 0 {
+		return embedEmpty, nil
+	}
+
+	return embedFound, nil
+}
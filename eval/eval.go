@@ -1,108 +1,607 @@
 package eval
 
 import (
-	"fmt"
 	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
-func eval(l *lexer, defines map[string]string, visited map[string]bool) bool {
-	return orExpr(l, defines, visited)
+// Value is the result of an integer constant expression; like intmax_t and
+// uintmax_t in #if, it is either a signed or an unsigned 64-bit integer.
+type Value struct {
+	Int      int64
+	Unsigned bool
 }
 
-func orExpr(l *lexer, defines map[string]string, visited map[string]bool) bool {
-	result := andExpr(l, defines, visited)
+func signed(v int64) Value {
+	return Value{Int: v}
+}
 
-	for {
-		t := l.Peek()
-		switch t.Kind {
-		case TokenKindOr:
-			l.Read()
-			right := andExpr(l, defines, visited)
-			result = result || right
-		default:
-			return result
-		}
+func boolean(b bool) Value {
+	if b {
+		return signed(1)
 	}
+
+	return signed(0)
 }
 
-func equalityExpr(l *lexer, defines map[string]string, visited map[string]bool) bool {
-	left := primaryExpr(l, defines, visited)
+func (v Value) Bool() bool {
+	return v.Int != 0
+}
 
-	t := l.Peek()
-	if t.Kind == TokenKindEquals {
-		l.Read()
-		right := primaryExpr(l, defines, visited)
-		return left == right
-	} else {
-		return left
+func (v Value) String() string {
+	if v.Unsigned {
+		return strconv.FormatUint(uint64(v.Int), 10)
 	}
+
+	return strconv.FormatInt(v.Int, 10)
+}
+
+type binaryOperator struct {
+	precedence int
 }
 
-func andExpr(l *lexer, defines map[string]string, visited map[string]bool) bool {
-	left := equalityExpr(l, defines, visited)
+var binaryOperators = map[TokenKind]binaryOperator{
+	TokenKindMultiply:      {10},
+	TokenKindDivide:        {10},
+	TokenKindModulo:        {10},
+	TokenKindPlus:          {9},
+	TokenKindMinus:         {9},
+	TokenKindShiftLeft:     {8},
+	TokenKindShiftRight:    {8},
+	TokenKindLess:          {7},
+	TokenKindLessEquals:    {7},
+	TokenKindGreater:       {7},
+	TokenKindGreaterEquals: {7},
+	TokenKindEquals:        {6},
+	TokenKindNotEquals:     {6},
+	TokenKindBitAnd:        {5},
+	TokenKindBitXor:        {4},
+	TokenKindBitOr:         {3},
+	TokenKindAnd:           {2},
+	TokenKindOr:            {1},
+}
+
+// parser evaluates an expression while parsing it; skip is non-zero while
+// parsing operands that are not evaluated, e.g. the right operand of a
+// short-circuited && or the unselected branch of ?:, in which errors like
+// division by zero are not reported.
+type parser struct {
+	l    *lexer
+	skip int
+}
+
+func (p *parser) text(t Token) string {
+	return string(p.l.s[t.Start:t.End])
+}
+
+// conditionalExpr parses a ternary expression, the lowest precedence level.
+func (p *parser) conditionalExpr() (Value, error) {
+	cond, err := p.binaryExpr(1)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if p.l.Peek().Kind != TokenKindQuestion {
+		return cond, nil
+	}
+
+	p.l.Read()
+
+	if !cond.Bool() {
+		p.skip++
+	}
+
+	left, err := p.conditionalExpr()
+	if err != nil {
+		return Value{}, err
+	}
+
+	if !cond.Bool() {
+		p.skip--
+	}
+
+	if t := p.l.Read(); t.Kind != TokenKindColon {
+		return Value{}, errors.New("missing ':' in conditional expression")
+	}
+
+	if cond.Bool() {
+		p.skip++
+	}
+
+	right, err := p.conditionalExpr()
+	if err != nil {
+		return Value{}, err
+	}
+
+	if cond.Bool() {
+		p.skip--
+	}
+
+	result := right
+	if cond.Bool() {
+		result = left
+	}
+
+	// the result has the common type of both branches
+	result.Unsigned = left.Unsigned || right.Unsigned
+
+	return result, nil
+}
+
+// binaryExpr parses binary operators of at least the given precedence
+// using precedence climbing.
+func (p *parser) binaryExpr(precedence int) (Value, error) {
+	left, err := p.unaryExpr()
+	if err != nil {
+		return Value{}, err
+	}
 
 	for {
-		t := l.Peek()
-		switch t.Kind {
-		case TokenKindAnd:
-			l.Read()
-			right := equalityExpr(l, defines, visited)
-			left = left && right
-		default:
-			return left
+		t := p.l.Peek()
+
+		op, ok := binaryOperators[t.Kind]
+		if !ok || op.precedence < precedence {
+			return left, nil
+		}
+
+		p.l.Read()
+
+		// short-circuit evaluation of && and ||
+		skip := t.Kind == TokenKindAnd && !left.Bool() || t.Kind == TokenKindOr && left.Bool()
+		if skip {
+			p.skip++
+		}
+
+		right, err := p.binaryExpr(op.precedence + 1)
+		if err != nil {
+			return Value{}, err
+		}
+
+		if skip {
+			p.skip--
+		}
+
+		left, err = p.binary(t, left, right)
+		if err != nil {
+			return Value{}, err
 		}
 	}
 }
-func primaryExpr(l *lexer, defines map[string]string, visited map[string]bool) bool {
-	t := l.Read()
+
+func (p *parser) binary(t Token, left, right Value) (Value, error) {
 	switch t.Kind {
-	case TokenKindID:
-		str := string(l.s[t.Start:t.End])
-		if visited[str] {
-			return false
+	case TokenKindAnd:
+		return boolean(left.Bool() && right.Bool()), nil
+	case TokenKindOr:
+		return boolean(left.Bool() || right.Bool()), nil
+	case TokenKindShiftLeft, TokenKindShiftRight:
+		return shift(t.Kind, left, right), nil
+	}
+
+	// usual arithmetic conversions: if either operand is unsigned, both are
+	unsigned := left.Unsigned || right.Unsigned
+
+	a, b := left.Int, right.Int
+	ua, ub := uint64(a), uint64(b)
+
+	switch t.Kind {
+	case TokenKindEquals:
+		return boolean(a == b), nil
+	case TokenKindNotEquals:
+		return boolean(a != b), nil
+	case TokenKindLess:
+		if unsigned {
+			return boolean(ua < ub), nil
+		}
+		return boolean(a < b), nil
+	case TokenKindLessEquals:
+		if unsigned {
+			return boolean(ua <= ub), nil
+		}
+		return boolean(a <= b), nil
+	case TokenKindGreater:
+		if unsigned {
+			return boolean(ua > ub), nil
+		}
+		return boolean(a > b), nil
+	case TokenKindGreaterEquals:
+		if unsigned {
+			return boolean(ua >= ub), nil
+		}
+		return boolean(a >= b), nil
+	}
+
+	result := Value{Unsigned: unsigned}
+
+	switch t.Kind {
+	case TokenKindPlus:
+		result.Int = a + b
+	case TokenKindMinus:
+		result.Int = a - b
+	case TokenKindMultiply:
+		result.Int = a * b
+	case TokenKindDivide, TokenKindModulo:
+		if b == 0 {
+			if p.skip > 0 {
+				return result, nil
+			}
+			return Value{}, errors.New("division by zero in expression")
 		}
 
-		v, ok := defines[str]
-		if !ok {
-			return false
+		switch {
+		case unsigned && t.Kind == TokenKindDivide:
+			result.Int = int64(ua / ub)
+		case unsigned:
+			result.Int = int64(ua % ub)
+		case b == -1:
+			// avoid the overflow trap of math.MinInt64 / -1
+			if t.Kind == TokenKindDivide {
+				result.Int = -a
+			}
+		case t.Kind == TokenKindDivide:
+			result.Int = a / b
+		default:
+			result.Int = a % b
 		}
+	case TokenKindBitAnd:
+		result.Int = a & b
+	case TokenKindBitOr:
+		result.Int = a | b
+	case TokenKindBitXor:
+		result.Int = a ^ b
+	}
 
-		visited[str] = true
+	return result, nil
+}
 
-		subLexer := NewLexer([]byte(v))
-		result := eval(subLexer, defines, visited)
-		visited[str] = false
+// shift implements << and >>; the result has the type of the left operand,
+// and a negative count shifts in the opposite direction.
+func shift(kind TokenKind, left, right Value) Value {
+	count := right.Int
+	if !right.Unsigned && count < 0 {
+		count = -count
+		if kind == TokenKindShiftLeft {
+			kind = TokenKindShiftRight
+		} else {
+			kind = TokenKindShiftLeft
+		}
+	}
 
+	result := Value{Unsigned: left.Unsigned}
+
+	if uint64(count) >= 64 {
+		if kind == TokenKindShiftRight && !left.Unsigned && left.Int < 0 {
+			result.Int = -1
+		}
 		return result
-	case TokenKindNumber:
-		str := string(l.s[t.Start:t.End])
+	}
+
+	switch {
+	case kind == TokenKindShiftLeft:
+		result.Int = left.Int << uint(count)
+	case left.Unsigned:
+		result.Int = int64(uint64(left.Int) >> uint(count))
+	default:
+		result.Int = left.Int >> uint(count)
+	}
+
+	return result
+}
 
-		v, err := strconv.ParseInt(str, 10, 64)
+func (p *parser) unaryExpr() (Value, error) {
+	t := p.l.Peek()
+
+	switch t.Kind {
+	case TokenKindPlus, TokenKindMinus, TokenKindBitNot, TokenKindNot:
+		p.l.Read()
+
+		v, err := p.unaryExpr()
 		if err != nil {
-			return false
+			return Value{}, err
+		}
+
+		switch t.Kind {
+		case TokenKindMinus:
+			v.Int = -v.Int
+		case TokenKindBitNot:
+			v.Int = ^v.Int
+		case TokenKindNot:
+			v = boolean(!v.Bool())
 		}
-		return v != 0
+
+		return v, nil
+	default:
+		return p.primaryExpr()
+	}
+}
+
+func (p *parser) primaryExpr() (Value, error) {
+	t := p.l.Read()
+	switch t.Kind {
+	case TokenKindID:
+		// identifiers remaining after macro expansion evaluate to 0
+		return signed(0), nil
+	case TokenKindNumber:
+		return parseInteger(p.text(t))
+	case TokenKindChar:
+		return parseChar(p.text(t))
 	case TokenKindLeftParen:
-		result := orExpr(l, defines, visited)
+		result, err := p.conditionalExpr()
+		if err != nil {
+			return Value{}, err
+		}
 
-		t = l.Read()
+		t = p.l.Read()
 		if t.Kind != TokenKindRightParen {
-			return false
+			return Value{}, errors.New("missing ')' in expression")
 		}
 
-		return result
+		return result, nil
+	case TokenKindNone:
+		return Value{}, errors.New("missing expression")
 	default:
-		fmt.Printf("Unexpected token in primaryExpr: %v\n", t)
-		return false
+		return Value{}, errors.Errorf("unexpected token in expression: '%s'", p.text(t))
+	}
+}
+
+// Evaluator evaluates #if expressions.
+type Evaluator struct {
+	// Defines maps identifiers to their replacement text.
+	Defines map[string]string
+	// Defined, when set, reports whether an identifier is defined for the
+	// defined operator instead of looking it up in Defines.
+	Defined func(id string) bool
+	// HasInclude reports whether a header can be included for the
+	// __has_include and, with next set, __has_include_next operators;
+	// global is set for the <...> form.
+	HasInclude func(path string, global bool, next bool) bool
+	// HasEmbed evaluates the __has_embed operator given the embed parameters
+	// following the header name: 0 if the resource is not found or a
+	// parameter is not supported, 1 if it is found and 2 if it is empty.
+	HasEmbed func(path string, global bool, params string) (int, error)
+}
+
+func (e *Evaluator) defined(id string) bool {
+	if e.Defined != nil {
+		return e.Defined(id)
+	}
+
+	_, ok := e.Defines[id]
+	return ok
+}
+
+// splitHeaderName splits a "..." or <...> header name off the start of
+// text; name is "" if text does not start with one.
+func splitHeaderName(text string) (name string, rest string) {
+	var end string
+	switch {
+	case strings.HasPrefix(text, `"`):
+		end = `"`
+	case strings.HasPrefix(text, "<"):
+		end = ">"
+	default:
+		return "", text
+	}
+
+	i := strings.Index(text[1:], end)
+	if i < 1 {
+		return "", text
+	}
+
+	return text[:i+2], text[i+2:]
+}
+
+// hasHeader evaluates the __has_include and __has_embed operators named id;
+// the header name is only macro-expanded if it is neither a "..." nor a
+// <...> form, and the embed parameters following it are passed as is.
+func (e *Evaluator) hasHeader(l *lexer, id string, visited map[string]bool) (string, Token, error) {
+	if t := l.Read(); t.Kind != TokenKindLeftParen {
+		return "", Token{}, errors.Errorf("missing '(' after '%s'", id)
+	}
+
+	name, ok := l.readHeaderName()
+
+	start := l.Peek().Start
+
+	depth := 0
+	for {
+		t := l.Peek()
+		if t.Kind == TokenKindNone || t.Kind == TokenKindRightParen && depth == 0 {
+			break
+		}
+
+		switch t.Kind {
+		case TokenKindLeftParen:
+			depth++
+		case TokenKindRightParen:
+			depth--
+		}
+
+		l.Read()
+	}
+
+	t := l.Read()
+	if t.Kind != TokenKindRightParen {
+		return "", Token{}, errors.Errorf("missing ')' after '%s' operand", id)
+	}
+
+	rest := string(l.s[start:t.Start])
+
+	if !ok {
+		expanded, err := e.expand(rest, visited)
+		if err != nil {
+			return "", Token{}, err
+		}
+
+		name, rest = splitHeaderName(strings.TrimSpace(expanded))
+	}
+
+	if len(name) < 3 {
+		return "", Token{}, errors.Errorf("operator '%s' requires a header name", id)
+	}
+
+	path, global := name[1:len(name)-1], name[0] == '<'
+
+	if id == "__has_embed" {
+		if e.HasEmbed == nil {
+			return "", Token{}, errors.Errorf("operator '%s' is not supported", id)
+		}
+
+		v, err := e.HasEmbed(path, global, strings.TrimSpace(rest))
+		if err != nil {
+			return "", Token{}, err
+		}
+
+		return strconv.Itoa(v), t, nil
+	}
+
+	if strings.TrimSpace(rest) != "" {
+		return "", Token{}, errors.Errorf("extra tokens in '%s' operand: '%s'", id, strings.TrimSpace(rest))
+	}
+
+	if e.HasInclude == nil {
+		return "", Token{}, errors.Errorf("operator '%s' is not supported", id)
+	}
+
+	if e.HasInclude(path, global, id == "__has_include_next") {
+		return "1", t, nil
+	}
+
+	return "0", t, nil
+}
+
+// expand evaluates the defined operator and replaces the remaining
+// identifiers with their definitions; an identifier is not replaced again
+// within its own replacement.
+func (e *Evaluator) expand(source string, visited map[string]bool) (string, error) {
+	var sb strings.Builder
+
+	l := NewLexer([]byte(source))
+
+	end := 0
+	for {
+		t := l.Read()
+		if t.Kind == TokenKindNone {
+			break
+		}
+
+		if t.Kind != TokenKindID {
+			continue
+		}
+
+		start := t.Start
+		id := source[t.Start:t.End]
+
+		var v string
+
+		if id == "__has_include" || id == "__has_include_next" || id == "__has_embed" {
+			var err error
+
+			v, t, err = e.hasHeader(l, id, visited)
+			if err != nil {
+				return "", err
+			}
+		} else if id == "defined" {
+			paren := l.Peek().Kind == TokenKindLeftParen
+			if paren {
+				l.Read()
+			}
+
+			operand := l.Read()
+			if operand.Kind != TokenKindID {
+				return "", errors.New("operator 'defined' requires an identifier")
+			}
+
+			if paren {
+				if t = l.Read(); t.Kind != TokenKindRightParen {
+					return "", errors.New("missing ')' after 'defined'")
+				}
+			} else {
+				t = operand
+			}
+
+			v = "0"
+			if e.defined(source[operand.Start:operand.End]) {
+				v = "1"
+			}
+		} else {
+			var ok bool
+
+			v, ok = e.Defines[id]
+			if !ok || visited[id] {
+				continue
+			}
+
+			visited[id] = true
+			expanded, err := e.expand(v, visited)
+			visited[id] = false
+
+			if err != nil {
+				return "", err
+			}
+
+			v = expanded
+		}
+
+		sb.WriteString(source[end:start])
+		sb.WriteString(" ")
+		sb.WriteString(v)
+		sb.WriteString(" ")
+		end = t.End
 	}
+
+	sb.WriteString(source[end:])
+
+	return sb.String(), nil
 }
 
-func Evaluate(source string, defines map[string]string) bool {
-	l := &lexer{
-		s: []byte(source),
+// EvaluateValue evaluates an #if expression after replacing identifiers with
+// their definitions; identifiers that are not defined evaluate to 0.
+func (e *Evaluator) EvaluateValue(source string) (Value, error) {
+	source, err := e.expand(source, map[string]bool{})
+	if err != nil {
+		return Value{}, err
+	}
+
+	p := &parser{
+		l: NewLexer([]byte(source)),
 	}
 
-	visited := map[string]bool{}
+	result, err := p.conditionalExpr()
+	if err != nil {
+		return Value{}, err
+	}
+
+	if t := p.l.Peek(); t.Kind != TokenKindNone {
+		return Value{}, errors.Errorf("unexpected token in expression: '%s'", p.text(t))
+	}
+
+	return result, nil
+}
+
+func (e *Evaluator) Evaluate(source string) (bool, error) {
+	v, err := e.EvaluateValue(source)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Bool(), nil
+}
+
+func EvaluateValue(source string, defines map[string]string) (Value, error) {
+	e := &Evaluator{
+		Defines: defines,
+	}
+
+	return e.EvaluateValue(source)
+}
+
+func Evaluate(source string, defines map[string]string) (bool, error) {
+	e := &Evaluator{
+		Defines: defines,
+	}
 
-	return eval(l, defines, visited)
+	return e.Evaluate(source)
 }
@@ -10,10 +10,16 @@ type evalTest struct {
 	source  string
 	defines map[string]string
 	want    bool
+	err     bool
 }
 
 func runEvalTest(t *testing.T, tt evalTest) {
-	actual := Evaluate(tt.source, tt.defines)
+	actual, err := Evaluate(tt.source, tt.defines)
+	if tt.err {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+	}
 	assert.Equal(t, tt.want, actual)
 }
 
@@ -22,6 +28,7 @@ func TestEvaluateEmpty(t *testing.T) {
 		source:  "",
 		defines: map[string]string{},
 		want:    false,
+		err:     true,
 	})
 }
 
@@ -30,6 +37,7 @@ func TestEvaluateWhitespace(t *testing.T) {
 		source:  " ",
 		defines: map[string]string{},
 		want:    false,
+		err:     true,
 	})
 }
 
@@ -553,3 +561,352 @@ func TestA1EqB1AndB1EqC0(t *testing.T) {
 		want: false,
 	})
 }
+
+func TestEvaluateMissingRightParen(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "(1",
+		defines: map[string]string{},
+		want:    false,
+		err:     true,
+	})
+}
+
+func TestEvaluateTrailingToken(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "1 1",
+		defines: map[string]string{},
+		want:    false,
+		err:     true,
+	})
+}
+
+type valueTest struct {
+	source  string
+	defines map[string]string
+	want    Value
+	err     bool
+}
+
+func runValueTest(t *testing.T, tt valueTest) {
+	actual, err := EvaluateValue(tt.source, tt.defines)
+	if tt.err {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, tt.want, actual)
+}
+
+func TestValueArithmetic(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 + 2 * 3 - 8 / 4 % 3", want: Value{Int: 5}})
+}
+
+func TestValueParentheses(t *testing.T) {
+	runValueTest(t, valueTest{source: "(1 + 2) * 3", want: Value{Int: 9}})
+}
+
+func TestValueUnary(t *testing.T) {
+	runValueTest(t, valueTest{source: "-a + ~0 + !0 + !5 + +1", defines: map[string]string{"a": "3"}, want: Value{Int: -2}})
+}
+
+func TestValueMinusWithoutSpaces(t *testing.T) {
+	runValueTest(t, valueTest{source: "a-1", defines: map[string]string{"a": "3"}, want: Value{Int: 2}})
+}
+
+func TestValueMacroIsNotParenthesized(t *testing.T) {
+	runValueTest(t, valueTest{source: "a * 2", defines: map[string]string{"a": "1 + 1"}, want: Value{Int: 3}})
+}
+
+func TestValueComparison(t *testing.T) {
+	runValueTest(t, valueTest{source: "(1 < 2) + (2 <= 2) + (3 > 2) + (2 >= 3) + (1 != 2) + (1 == 2)", want: Value{Int: 4}})
+}
+
+func TestValueShift(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 << 4 >> 2", want: Value{Int: 4}})
+}
+
+func TestValueShiftNegative(t *testing.T) {
+	runValueTest(t, valueTest{source: "-16 >> 2", want: Value{Int: -4}})
+}
+
+func TestValueBitwise(t *testing.T) {
+	runValueTest(t, valueTest{source: "6 & 3 | 8 ^ 1", want: Value{Int: 11}})
+}
+
+func TestValueTernary(t *testing.T) {
+	runValueTest(t, valueTest{source: "0 ? 1 : 2 ? 3 : 4", want: Value{Int: 3}})
+}
+
+func TestValueLogical(t *testing.T) {
+	runValueTest(t, valueTest{source: "2 && 3 || 0", want: Value{Int: 1}})
+}
+
+func TestValueDivisionByZero(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 / 0", err: true})
+}
+
+func TestValueShortCircuitDivisionByZero(t *testing.T) {
+	runValueTest(t, valueTest{source: "0 && 1 / 0 || 1 || 1 % 0", want: Value{Int: 1}})
+}
+
+func TestValueTernaryDivisionByZero(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 ? 2 : 1 / 0", want: Value{Int: 2}})
+}
+
+func TestValueUnsignedLiteral(t *testing.T) {
+	runValueTest(t, valueTest{source: "18446744073709551615", want: Value{Int: -1, Unsigned: true}})
+}
+
+func TestValueUnsignedComparison(t *testing.T) {
+	runValueTest(t, valueTest{source: "-1 < 18446744073709551615 - 1", want: Value{Int: 0}})
+}
+
+func TestValueMissingColon(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 ? 2", err: true})
+}
+
+func TestValueMissingOperand(t *testing.T) {
+	runValueTest(t, valueTest{source: "1 +", err: true})
+}
+
+func TestEvaluateDefined(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "defined(a) && defined b",
+		defines: map[string]string{"a": "0", "b": ""},
+		want:    true,
+	})
+}
+
+func TestEvaluateDefinedUndefined(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "defined a || defined ( b )",
+		defines: map[string]string{},
+		want:    false,
+	})
+}
+
+func TestEvaluateDefinedOperandNotExpanded(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "defined(a)",
+		defines: map[string]string{"a": "b"},
+		want:    true,
+	})
+}
+
+func TestEvaluateNotDefined(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "a >= 3 && !defined(b)",
+		defines: map[string]string{"a": "3"},
+		want:    true,
+	})
+}
+
+func TestEvaluateDefinedInDefine(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "a",
+		defines: map[string]string{"a": "defined(b)", "b": "0"},
+		want:    true,
+	})
+}
+
+func TestEvaluateDefinedWithoutIdentifier(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "defined(1)",
+		defines: map[string]string{},
+		want:    false,
+		err:     true,
+	})
+}
+
+func TestEvaluateDefinedMissingParen(t *testing.T) {
+	runEvalTest(t, evalTest{
+		source:  "defined(a",
+		defines: map[string]string{"a": "1"},
+		want:    false,
+		err:     true,
+	})
+}
+
+func TestEvaluatorDefined(t *testing.T) {
+	e := &Evaluator{
+		Defined: func(id string) bool {
+			return id == "a"
+		},
+	}
+
+	actual, err := e.Evaluate("defined(a) && !defined(b)")
+	assert.NoError(t, err)
+	assert.True(t, actual)
+}
+
+func TestValueHex(t *testing.T) {
+	runValueTest(t, valueTest{source: "0x10 + 0XfF", want: Value{Int: 271}})
+}
+
+func TestValueOctal(t *testing.T) {
+	runValueTest(t, valueTest{source: "0755 + 0", want: Value{Int: 493}})
+}
+
+func TestValueBinary(t *testing.T) {
+	runValueTest(t, valueTest{source: "0b1010", want: Value{Int: 10}})
+}
+
+func TestValueSuffixes(t *testing.T) {
+	runValueTest(t, valueTest{source: "10l + 10LL + 10z", want: Value{Int: 30}})
+}
+
+func TestValueUnsignedSuffixes(t *testing.T) {
+	runValueTest(t, valueTest{source: "10UL + 1uz + 1llu", want: Value{Int: 12, Unsigned: true}})
+}
+
+func TestValueUnsignedSuffixComparison(t *testing.T) {
+	runValueTest(t, valueTest{source: "-1 > 0u", want: Value{Int: 1}})
+}
+
+func TestValueDigitSeparators(t *testing.T) {
+	runValueTest(t, valueTest{source: "1'000'000 + 0x1'00", want: Value{Int: 1000256}})
+}
+
+func TestValueLargeHexIsUnsigned(t *testing.T) {
+	runValueTest(t, valueTest{source: "0xFFFFFFFFFFFFFFFF", want: Value{Int: -1, Unsigned: true}})
+}
+
+func TestValueInvalidSuffix(t *testing.T) {
+	runValueTest(t, valueTest{source: "10lL", err: true})
+}
+
+func TestValueInvalidOctal(t *testing.T) {
+	runValueTest(t, valueTest{source: "09", err: true})
+}
+
+func TestValueFloat(t *testing.T) {
+	runValueTest(t, valueTest{source: "1.5", err: true})
+}
+
+func TestValueTooLarge(t *testing.T) {
+	runValueTest(t, valueTest{source: "0x1FFFFFFFFFFFFFFFF", err: true})
+}
+
+func TestValueChar(t *testing.T) {
+	runValueTest(t, valueTest{source: "'A'", want: Value{Int: 65}})
+}
+
+func TestValueCharEscapes(t *testing.T) {
+	runValueTest(t, valueTest{source: "'\\n' + '\\'' + '\\\\' + '\\x41' + '\\101' + '\\0'", want: Value{Int: 10 + 39 + 92 + 65 + 65}})
+}
+
+func TestValueCharSigned(t *testing.T) {
+	runValueTest(t, valueTest{source: "'\\xff'", want: Value{Int: -1}})
+}
+
+func TestValueMultiChar(t *testing.T) {
+	runValueTest(t, valueTest{source: "'ab'", want: Value{Int: 'a'<<8 | 'b'}})
+}
+
+func TestValueWideChar(t *testing.T) {
+	runValueTest(t, valueTest{source: "L'\\u00e9'", want: Value{Int: 0xe9}})
+}
+
+func TestValueUTF16Char(t *testing.T) {
+	runValueTest(t, valueTest{source: "u'\\xffff'", want: Value{Int: 0xffff, Unsigned: true}})
+}
+
+func TestValueUTF32Char(t *testing.T) {
+	runValueTest(t, valueTest{source: "U'é'", want: Value{Int: 0xe9, Unsigned: true}})
+}
+
+func TestValueUTF8Char(t *testing.T) {
+	runValueTest(t, valueTest{source: "u8'a'", want: Value{Int: 'a', Unsigned: true}})
+}
+
+func TestValueEmptyChar(t *testing.T) {
+	runValueTest(t, valueTest{source: "''", err: true})
+}
+
+func TestValueUnknownEscape(t *testing.T) {
+	runValueTest(t, valueTest{source: "'\\q'", err: true})
+}
+
+func TestEvaluatorHasInclude(t *testing.T) {
+	type include struct {
+		path   string
+		global bool
+		next   bool
+	}
+
+	var includes []include
+
+	e := &Evaluator{
+		Defines: map[string]string{
+			"HEADER": "<vector>",
+			"linux":  "1",
+		},
+		HasInclude: func(path string, global bool, next bool) bool {
+			includes = append(includes, include{path, global, next})
+			return path != "missing.h"
+		},
+	}
+
+	for _, test := range []struct {
+		source string
+		want   bool
+	}{
+		{`__has_include("config.h")`, true},
+		{`__has_include(<linux/version.h>) && __has_include_next( <optional> )`, true},
+		{`__has_include(HEADER)`, true},
+		{`__has_include("missing.h") || 0`, false},
+		{`!__has_include("a)b.h")`, false},
+	} {
+		actual, err := e.Evaluate(test.source)
+		assert.NoError(t, err, test.source)
+		assert.Equal(t, test.want, actual, test.source)
+	}
+
+	assert.Equal(t, []include{
+		{"config.h", false, false},
+		{"linux/version.h", true, false},
+		{"optional", true, true},
+		{"vector", true, false},
+		{"missing.h", false, false},
+		{"a)b.h", false, false},
+	}, includes)
+
+	for _, source := range []string{
+		`__has_include`,
+		`__has_include(`,
+		`__has_include("config.h"`,
+		`__has_include()`,
+		`__has_include(config)`,
+	} {
+		_, err := e.Evaluate(source)
+		assert.Error(t, err, source)
+	}
+
+	_, err := Evaluate(`__has_include("config.h")`, nil)
+	assert.Error(t, err)
+}
+
+func TestEvaluatorHasEmbed(t *testing.T) {
+	var params []string
+
+	e := &Evaluator{
+		Defines: map[string]string{
+			"RESOURCE": `"data.bin" limit(4)`,
+		},
+		HasEmbed: func(path string, global bool, p string) (int, error) {
+			params = append(params, p)
+			if path == "missing.bin" {
+				return 0, nil
+			}
+			return 1, nil
+		},
+	}
+
+	v, err := e.EvaluateValue(`__has_embed(<data.bin> prefix((1)) limit(2)) + __has_embed(RESOURCE) + __has_embed("missing.bin")`)
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Int: 2}, v)
+	assert.Equal(t, []string{"prefix((1)) limit(2)", "limit(4)", ""}, params)
+
+	_, err = e.Evaluate(`__has_include("data.bin" limit(1))`)
+	assert.Error(t, err)
+}
@@ -1,6 +1,9 @@
 package eval
 
-import "unicode/utf8"
+import (
+	"bytes"
+	"unicode/utf8"
+)
 
 type TokenKind int
 
@@ -8,14 +11,65 @@ const (
 	TokenKindNone TokenKind = iota
 	TokenKindID
 	TokenKindNumber
+	TokenKindChar
 	TokenKindLeftParen
 	TokenKindRightParen
 	TokenKindAnd
 	TokenKindOr
 	TokenKindEquals
+	TokenKindNotEquals
+	TokenKindLess
+	TokenKindLessEquals
+	TokenKindGreater
+	TokenKindGreaterEquals
+	TokenKindPlus
+	TokenKindMinus
+	TokenKindMultiply
+	TokenKindDivide
+	TokenKindModulo
+	TokenKindShiftLeft
+	TokenKindShiftRight
+	TokenKindBitAnd
+	TokenKindBitOr
+	TokenKindBitXor
+	TokenKindBitNot
+	TokenKindNot
+	TokenKindQuestion
+	TokenKindColon
 	TokenKindOther
 )
 
+// operators lists the operator spellings, longer ones first.
+var operators = []struct {
+	text string
+	kind TokenKind
+}{
+	{"&&", TokenKindAnd},
+	{"||", TokenKindOr},
+	{"==", TokenKindEquals},
+	{"!=", TokenKindNotEquals},
+	{"<=", TokenKindLessEquals},
+	{">=", TokenKindGreaterEquals},
+	{"<<", TokenKindShiftLeft},
+	{">>", TokenKindShiftRight},
+	{"(", TokenKindLeftParen},
+	{")", TokenKindRightParen},
+	{"<", TokenKindLess},
+	{">", TokenKindGreater},
+	{"+", TokenKindPlus},
+	{"-", TokenKindMinus},
+	{"*", TokenKindMultiply},
+	{"/", TokenKindDivide},
+	{"%", TokenKindModulo},
+	{"&", TokenKindBitAnd},
+	{"|", TokenKindBitOr},
+	{"^", TokenKindBitXor},
+	{"~", TokenKindBitNot},
+	{"!", TokenKindNot},
+	{"?", TokenKindQuestion},
+	{":", TokenKindColon},
+}
+
 type Token struct {
 	Kind  TokenKind
 	Start int
@@ -74,89 +128,92 @@ func (l *lexer) read() Token {
 	}
 
 	r, w := utf8.DecodeRune(l.s[l.end:])
+
+	for _, prefix := range []string{"'", "L'", "u'", "U'", "u8'"} {
+		if bytes.HasPrefix(l.s[l.end:], []byte(prefix)) {
+			return l.readCharOrOther(len(prefix))
+		}
+	}
+
 	if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
 		return l.readID()
 	}
 
-	if r == '-' || ('0' <= r && r <= '9') {
+	if '0' <= r && r <= '9' {
 		return l.readNumberOrOther()
 	}
 
-	if r == '&' && l.end+w < len(l.s) {
-		r2, w2 := utf8.DecodeRune(l.s[l.end+w:])
-		if r2 == '&' {
-			l.end += w + w2
-
-			start := l.start
-			l.start = l.end
-
-			return Token{
-				Kind:  TokenKindAnd,
-				Start: start,
-				End:   l.end,
-			}
+	if r == '-' && l.end+w < len(l.s) && !l.operand() {
+		// a minus sign directly preceding a number, where no operand is
+		// expected to end, is read as part of a negative number
+		r2, _ := utf8.DecodeRune(l.s[l.end+w:])
+		if '0' <= r2 && r2 <= '9' {
+			return l.readNumberOrOther()
 		}
 	}
 
-	if r == '|' && l.end+w < len(l.s) {
-		r2, w2 := utf8.DecodeRune(l.s[l.end+w:])
-		if r2 == '|' {
-			l.end += w + w2
+	for _, op := range operators {
+		if bytes.HasPrefix(l.s[l.end:], []byte(op.text)) {
+			l.end += len(op.text)
 
 			start := l.start
 			l.start = l.end
 
 			return Token{
-				Kind:  TokenKindOr,
+				Kind:  op.kind,
 				Start: start,
 				End:   l.end,
 			}
 		}
 	}
 
-	// Inside lexer's Read() function
-	if r == '=' && l.end+w < len(l.s) {
-		r2, w2 := utf8.DecodeRune(l.s[l.end+w:])
-		if r2 == '=' {
-			l.end += w + w2
-
-			start := l.start
-			l.start = l.end
+	return l.readOther()
+}
 
-			return Token{
-				Kind:  TokenKindEquals,
-				Start: start,
-				End:   l.end,
-			}
-		}
+// operand reports whether the last token read ends an operand.
+func (l *lexer) operand() bool {
+	if len(l.ts) == 0 {
+		return false
 	}
 
-	switch r {
-	case '(':
-		l.end += w
+	switch l.ts[len(l.ts)-1].Kind {
+	case TokenKindID, TokenKindNumber, TokenKindRightParen:
+		return true
+	}
 
-		start := l.start
-		l.start = l.end
+	return false
+}
 
-		return Token{
-			Kind:  TokenKindLeftParen,
-			Start: start,
-			End:   l.end,
-		}
-	case ')':
-		l.end += w
+// readHeaderName reads a "..." or <...> header name at the current position,
+// which must not have been peeked past.
+func (l *lexer) readHeaderName() (string, bool) {
+	l.skipWhitespace()
 
-		start := l.start
-		l.start = l.end
+	if l.i < len(l.ts) || l.end >= len(l.s) {
+		return "", false
+	}
 
-		return Token{
-			Kind:  TokenKindRightParen,
-			Start: start,
-			End:   l.end,
-		}
+	var end byte
+	switch l.s[l.end] {
+	case '"':
+		end = '"'
+	case '<':
+		end = '>'
 	default:
-		return l.readOther()
+		return "", false
+	}
+
+	i := bytes.IndexByte(l.s[l.end+1:], end)
+	if i < 0 {
+		return "", false
 	}
+
+	name := string(l.s[l.end : l.end+i+2])
+
+	l.end += i + 2
+	l.start = l.end
+
+	return name, true
 }
 
 func (l *lexer) skipWhitespace() {
@@ -193,17 +250,8 @@ func (l *lexer) readID() Token {
 }
 
 func (l *lexer) readOther() Token {
-loop:
-	for l.end < len(l.s) {
-		r, w := utf8.DecodeRune(l.s[l.end:])
-
-		switch r {
-		case ' ', '\t', '\n':
-			break loop
-		}
-
-		l.end += w
-	}
+	_, w := utf8.DecodeRune(l.s[l.end:])
+	l.end += w
 
 	start := l.start
 	l.start = l.end
@@ -215,31 +263,42 @@ loop:
 	}
 }
 
+// readNumberOrOther reads a preprocessing number, i.e. digits followed by
+// letters, digits, dots and digit separators; its validity as an integer
+// constant is checked when it is evaluated.
 func (l *lexer) readNumberOrOther() Token {
 	// read first rune and make sure it is a digit or -
 
 	r, w := utf8.DecodeRune(l.s[l.end:])
 	if r == '-' {
 		// read next and make sure it's digit
-		r, w = utf8.DecodeRune(l.s[l.end+w:])
+		r, _ = utf8.DecodeRune(l.s[l.end+w:])
 		if r < '0' || '9' < r {
 			return l.readOther()
 		}
 		l.end += w
 	}
 
-	// Read the remaining digits
 	for l.end < len(l.s) {
 		r, w := utf8.DecodeRune(l.s[l.end:])
-		if '0' <= r && r <= '9' {
+
+		switch {
+		case r == '_' || r == '.' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z'):
 			l.end += w
-		} else if r == ' ' || r == '\t' || r == '\n' {
-			break
-		} else {
-			return l.readOther()
+		case (r == '+' || r == '-') && bytes.ContainsAny(l.s[l.end-1:l.end], "eEpP"):
+			l.end += w
+		case r == '\'' && l.end+w < len(l.s) && isDigitOrLetter(l.s[l.end+w]):
+			// digit separator
+			l.end += w
+		default:
+			return l.number()
 		}
 	}
 
+	return l.number()
+}
+
+func (l *lexer) number() Token {
 	start := l.start
 	l.start = l.end
 
@@ -249,3 +308,38 @@ func (l *lexer) readNumberOrOther() Token {
 		End:   l.end,
 	}
 }
+
+func isDigitOrLetter(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// readCharOrOther reads a character constant whose opening quote follows a
+// prefix of the given length.
+func (l *lexer) readCharOrOther(prefix int) Token {
+	end := l.end + prefix
+
+	for end < len(l.s) {
+		switch l.s[end] {
+		case '\\':
+			end += 2
+			continue
+		case '\'':
+			l.end = end + 1
+
+			start := l.start
+			l.start = l.end
+
+			return Token{
+				Kind:  TokenKindChar,
+				Start: start,
+				End:   l.end,
+			}
+		case '\n':
+			return l.readOther()
+		}
+
+		end++
+	}
+
+	return l.readOther()
+}
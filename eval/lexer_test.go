@@ -142,3 +142,62 @@ func TestLexerIDEqualsNumber(t *testing.T) {
 		{Kind: TokenKindNumber, Start: 7, End: 10},
 	})
 }
+
+func TestLexerOperators(t *testing.T) {
+	runLexerTest(t, "!a != ~b<<1", []Token{
+		{Kind: TokenKindNot, Start: 0, End: 1},
+		{Kind: TokenKindID, Start: 1, End: 2},
+		{Kind: TokenKindNotEquals, Start: 3, End: 5},
+		{Kind: TokenKindBitNot, Start: 6, End: 7},
+		{Kind: TokenKindID, Start: 7, End: 8},
+		{Kind: TokenKindShiftLeft, Start: 8, End: 10},
+		{Kind: TokenKindNumber, Start: 10, End: 11},
+	})
+}
+
+func TestLexerBinaryMinus(t *testing.T) {
+	runLexerTest(t, "a-1", []Token{
+		{Kind: TokenKindID, Start: 0, End: 1},
+		{Kind: TokenKindMinus, Start: 1, End: 2},
+		{Kind: TokenKindNumber, Start: 2, End: 3},
+	})
+}
+
+func TestLexerTernary(t *testing.T) {
+	runLexerTest(t, "a?1:2", []Token{
+		{Kind: TokenKindID, Start: 0, End: 1},
+		{Kind: TokenKindQuestion, Start: 1, End: 2},
+		{Kind: TokenKindNumber, Start: 2, End: 3},
+		{Kind: TokenKindColon, Start: 3, End: 4},
+		{Kind: TokenKindNumber, Start: 4, End: 5},
+	})
+}
+
+func TestLexerHexNumberWithSuffix(t *testing.T) {
+	runLexerTest(t, "0x1fULL", []Token{
+		{Kind: TokenKindNumber, Start: 0, End: 7},
+	})
+}
+
+func TestLexerNumberWithSeparators(t *testing.T) {
+	runLexerTest(t, "1'000 + 2", []Token{
+		{Kind: TokenKindNumber, Start: 0, End: 5},
+		{Kind: TokenKindPlus, Start: 6, End: 7},
+		{Kind: TokenKindNumber, Start: 8, End: 9},
+	})
+}
+
+func TestLexerChar(t *testing.T) {
+	runLexerTest(t, "'a' == '\\''", []Token{
+		{Kind: TokenKindChar, Start: 0, End: 3},
+		{Kind: TokenKindEquals, Start: 4, End: 6},
+		{Kind: TokenKindChar, Start: 7, End: 11},
+	})
+}
+
+func TestLexerPrefixedChar(t *testing.T) {
+	runLexerTest(t, "u8'a' L'b'", []Token{
+		{Kind: TokenKindChar, Start: 0, End: 5},
+		{Kind: TokenKindChar, Start: 6, End: 10},
+	})
+}
@@ -0,0 +1,233 @@
+package eval
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// integerSuffixes lists the valid integer suffixes without the unsigned u,
+// which may precede or follow them.
+var integerSuffixes = []string{"", "l", "L", "ll", "LL", "z", "Z"}
+
+// parseInteger parses a C/C++ integer constant, including hexadecimal,
+// octal and binary forms, digit separators and type suffixes.
+func parseInteger(text string) (Value, error) {
+	s := strings.ReplaceAll(text, "'", "")
+
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base = 16
+		s = s[2:]
+	case strings.HasPrefix(s, "0b") || strings.HasPrefix(s, "0B"):
+		base = 2
+		s = s[2:]
+	case strings.HasPrefix(s, "0"):
+		base = 8
+	}
+
+	i := 0
+	for i < len(s) && isBaseDigit(s[i], base) {
+		i++
+	}
+
+	digits, suffix := s[:i], s[i:]
+
+	if strings.ContainsAny(suffix, ".") || base != 16 && strings.ContainsAny(suffix, "eE") || base == 16 && strings.ContainsAny(suffix, "pP") {
+		return Value{}, errors.Errorf("floating constant in preprocessor expression: '%s'", text)
+	}
+
+	if digits == "" {
+		return Value{}, errors.Errorf("invalid integer constant: '%s'", text)
+	}
+
+	unsigned := false
+	if i := strings.IndexAny(suffix, "uU"); i >= 0 {
+		unsigned = true
+		suffix = suffix[:i] + suffix[i+1:]
+	}
+
+	valid := false
+	for _, s := range integerSuffixes {
+		if suffix == s {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return Value{}, errors.Errorf("invalid suffix on integer constant: '%s'", text)
+	}
+
+	v, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		return Value{}, errors.Errorf("integer constant is too large: '%s'", text)
+	}
+
+	// a constant that does not fit intmax_t is unsigned
+	if v > math.MaxInt64 {
+		unsigned = true
+	}
+
+	result := Value{
+		Int:      int64(v),
+		Unsigned: unsigned,
+	}
+
+	if negative {
+		result.Int = -result.Int
+	}
+
+	return result, nil
+}
+
+func isBaseDigit(c byte, base int) bool {
+	switch base {
+	case 2:
+		return c == '0' || c == '1'
+	case 8:
+		return '0' <= c && c <= '7'
+	case 10:
+		return '0' <= c && c <= '9'
+	default:
+		return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+	}
+}
+
+var simpleEscapes = map[byte]uint32{
+	'\'': '\'',
+	'"':  '"',
+	'?':  '?',
+	'\\': '\\',
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'e':  0x1b,
+}
+
+// appendUTF8 appends the UTF-8 encoding of r as separate chars.
+func appendUTF8(chars []uint32, r rune) []uint32 {
+	for _, b := range utf8.AppendRune(nil, r) {
+		chars = append(chars, uint32(b))
+	}
+
+	return chars
+}
+
+// parseChar parses a character constant, optionally prefixed with L, u, U
+// or u8; like GCC, plain char is signed and multi-character constants
+// combine their characters into an int.
+func parseChar(text string) (Value, error) {
+	quote := strings.IndexByte(text, '\'')
+	prefix := text[:quote]
+	body := text[quote+1 : len(text)-1]
+
+	var chars []uint32
+
+	for len(body) > 0 {
+		if body[0] != '\\' {
+			r, w := utf8.DecodeRuneInString(body)
+			body = body[w:]
+
+			if prefix == "" || prefix == "u8" {
+				chars = appendUTF8(chars, r)
+			} else {
+				chars = append(chars, uint32(r))
+			}
+			continue
+		}
+
+		if len(body) < 2 {
+			return Value{}, errors.Errorf("invalid escape sequence in character constant: %s", text)
+		}
+
+		c := body[1]
+		body = body[2:]
+
+		if v, ok := simpleEscapes[c]; ok {
+			chars = append(chars, v)
+			continue
+		}
+
+		var digits string
+		base := 16
+
+		switch {
+		case '0' <= c && c <= '7':
+			base = 8
+			digits = string(c)
+			for len(digits) < 3 && len(body) > 0 && '0' <= body[0] && body[0] <= '7' {
+				digits += body[:1]
+				body = body[1:]
+			}
+		case c == 'x':
+			for len(body) > 0 && isBaseDigit(body[0], 16) {
+				digits += body[:1]
+				body = body[1:]
+			}
+		case c == 'u' || c == 'U':
+			n := 4
+			if c == 'U' {
+				n = 8
+			}
+			if len(body) < n {
+				return Value{}, errors.Errorf("incomplete universal character name in character constant: %s", text)
+			}
+			digits, body = body[:n], body[n:]
+		default:
+			return Value{}, errors.Errorf("unknown escape sequence '\\%c' in character constant: %s", c, text)
+		}
+
+		v, err := strconv.ParseUint(digits, base, 32)
+		if err != nil {
+			return Value{}, errors.Errorf("invalid escape sequence in character constant: %s", text)
+		}
+
+		if (c == 'u' || c == 'U') && (prefix == "" || prefix == "u8") {
+			chars = appendUTF8(chars, rune(v))
+			continue
+		}
+
+		chars = append(chars, uint32(v))
+	}
+
+	if len(chars) == 0 {
+		return Value{}, errors.Errorf("empty character constant: %s", text)
+	}
+
+	switch prefix {
+	case "L":
+		// wchar_t is a signed 32-bit int; multi-character constants use the
+		// last character
+		return signed(int64(int32(chars[len(chars)-1]))), nil
+	case "u":
+		return Value{Int: int64(uint16(chars[len(chars)-1])), Unsigned: true}, nil
+	case "U":
+		return Value{Int: int64(chars[len(chars)-1]), Unsigned: true}, nil
+	}
+
+	if len(chars) == 1 {
+		if prefix == "u8" {
+			return Value{Int: int64(uint8(chars[0])), Unsigned: true}, nil
+		}
+
+		return signed(int64(int8(chars[0]))), nil
+	}
+
+	var v uint32
+	for _, c := range chars {
+		v = v<<8 | uint32(uint8(c))
+	}
+
+	return signed(int64(int32(v))), nil
+}
@@ -0,0 +1,18 @@
+int line = __LINE__;
+#define CALL(x) x
+int call = CALL(
+    __LINE__);
+#include "builtin.h"
+int level = __INCLUDE_LEVEL__;
+const char *file = __FILE__;
+int a = __COUNTER__, b = __COUNTER__;
+#if __LINE__ == 9
+int ten;
+#endif
+#line 100 "renamed.c"
+const char *renamed = __FILE__; int hundred = __LINE__;
+const char *date = __DATE__;
+const char *time = __TIME__;
+#ifdef __COUNTER__
+int c = __COUNTER__;
+#endif
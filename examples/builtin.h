@@ -0,0 +1,3 @@
+const char *header = __FILE__;
+int header_level = __INCLUDE_LEVEL__;
+int header_line = __LINE__;
@@ -0,0 +1,21 @@
+int line = 1;
+
+int call = 4;
+
+const char *header = "builtin.h";
+int header_level = 1;
+int header_line = 3;
+
+int level = 0;
+const char *file = "builtin.cpp";
+int a = 0, b = 1;
+
+int ten;
+
+
+const char *renamed = "renamed.c"; int hundred = 100;
+const char *date = "Mar  5 2024";
+const char *time = "07:08:09";
+
+int c = 2;
+
@@ -0,0 +1,10 @@
+#define HEADER "once.h"
+#define STR(x) #x
+#define XSTR(x) STR(x)
+#define NAME not_once
+#define SYSTEM <not_once.h>
+#include HEADER
+#include XSTR(NAME.h)
+#include SYSTEM
+#include NAME
+#include
@@ -0,0 +1,11 @@
+
+
+
+
+
+
+const int v = 1;
+const int v = 1;
+const int v = 1;
+
+
@@ -0,0 +1,37 @@
+#define SWAP(a, b) \
+    do { \
+        int t = a; \
+        a = b; \
+        b = t; \
+    } while (0)
+#define LONG_VALUE 1 + \
+2
+
+#if LONG_VALUE == 3 && \
+    defined(SWAP)
+void swap(int x, int y) { SWAP(x, y); }
+#endif
+
+// a comment \
+continued on the next line
+const char *s = "a string \
+literal";
+/* block *\
+/
+int after = __LINE__;
+#ifndef A /* why
+  because */
+int guarded_by_a;
+#else /* an
+  else */
+int not_a;
+#endif /* end
+  of A */
+#include "not_once.h" /* a
+b */
+#define X 1 /* a
+b */
+#undef Y /* a
+b */
+int x = X;
+int line = __LINE__;
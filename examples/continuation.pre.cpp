@@ -0,0 +1,37 @@
+
+
+
+
+
+
+
+
+
+
+
+void swap(int x, int y) { do {         int t = x;         x = y;         y = t;     } while (0); }
+
+
+// a comment continued on the next line
+
+const char *s = "a string literal";
+
+/* block */
+
+int after = 21;
+
+
+int guarded_by_a;
+
+
+
+
+
+const int v = 1;
+
+
+
+
+
+int x = 1  ;
+int line = 37;
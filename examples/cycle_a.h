@@ -0,0 +1,2 @@
+int a;
+#include "cycle_b.h"
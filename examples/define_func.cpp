@@ -0,0 +1,8 @@
+#define SHA_PREFIX "sha-"
+const char *sha = SHA_PREFIX GIT_SHA;
+const char *where = WHERE;
+int sum = SUM(1, 2 + 3,
+    4);
+const char *joined = JOIN(a, b c, SHA_PREFIX);
+const char *empty = JOIN();
+int error = FAIL(1);
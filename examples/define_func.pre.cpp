@@ -0,0 +1,8 @@
+
+const char *sha = "sha-" "0123abc";
+const char *where = ":3 WHERE";
+int sum = (1) + (2 + 3) + (4);
+
+const char *joined = "a, b c, SHA_PREFIX" a, b c, "sha-";
+const char *empty = "" ;
+int error = ;
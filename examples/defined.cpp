@@ -0,0 +1,21 @@
+#define FOO BAR
+#define EMPTY
+#define F(x) x
+
+#if defined(FOO) || defined BAR
+const int A = 1;
+#endif
+
+#if defined EMPTY && defined(F) && !defined(BAR)
+const int B = 2;
+#endif
+
+#if defined(UNDEFINED)
+const int C = 3;
+#elif !defined UNDEFINED
+const int D = 4;
+#endif
+
+#if F(defined(FOO))
+const int E = 5;
+#endif
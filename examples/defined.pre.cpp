@@ -0,0 +1,21 @@
+
+
+
+
+
+const int A = 1;
+
+
+
+const int B = 2;
+
+
+
+
+
+const int D = 4;
+
+
+
+const int E = 5;
+
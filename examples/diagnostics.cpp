@@ -0,0 +1,14 @@
+#include "missing.h"
+#define F(a) a
+int a = F(1, 2);
+#if 1 +
+#endif
+#define CAT(a, b) a ## b
+int b = CAT(+, -);
+#define X 1
+#define X 2
+#endif
+#if 1
+#define Y \
+  1
+#undef
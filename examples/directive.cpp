@@ -0,0 +1,10 @@
+#feature fast_math // enables fast math
+int a;
+#if 0
+#feature skipped
+#endif
+#import_shader common
+int b;
+#feature
+#unknown directive
+int fast = FEATURE_FAST_MATH;
@@ -0,0 +1,10 @@
+
+int a;
+
+
+
+vec4 common();
+int b;
+
+#unknown directive
+int fast = 1;
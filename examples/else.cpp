@@ -0,0 +1,33 @@
+#if 0
+#if 0
+#else
+const int A = 1;
+#endif
+#endif
+
+#if 1
+const int B = 2;
+#elif 1
+const int C = 3;
+#else
+const int D = 4;
+#endif
+
+#if 0
+#elif 1
+const int E = 5;
+#elif 1
+const int F = 6;
+#else
+const int G = 7;
+#endif
+
+#if 0
+  #endif
+const int H = 8;
+
+#if 0
+const int I = 9;
+  #  else
+const int J = 10;
+	#endif
@@ -0,0 +1,33 @@
+
+
+
+
+
+
+
+
+const int B = 2;
+
+
+
+
+
+
+
+
+const int E = 5;
+
+
+
+
+
+
+
+
+const int H = 8;
+
+
+
+
+const int J = 10;
+	
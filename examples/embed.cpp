@@ -0,0 +1,26 @@
+#define RESOURCE "embed/abc.bin"
+#define TWO 2
+const unsigned char all[] = {
+#embed "embed/abc.bin"
+};
+const unsigned char limited[] = {
+#embed RESOURCE limit(TWO) prefix(0x00, ) suffix(, 0xff) // comment
+};
+const unsigned char empty[] = {
+#embed <embed/empty.bin> __if_empty__(0) prefix(1,)
+};
+#if __has_embed("embed/abc.bin") == __STDC_EMBED_FOUND__ && __has_embed("embed/abc.bin" limit(0)) == __STDC_EMBED_EMPTY__
+int found;
+#endif
+#if __has_embed(<embed/empty.bin>) == 2 && __has_embed("missing.bin") == 0 && __has_embed("embed/abc.bin" gnu::offset(1)) == 0
+int empty;
+#endif
+#if defined(__has_embed) && __has_embed(RESOURCE if_empty(x) unknown(1)) == __STDC_EMBED_NOT_FOUND__
+int unknown;
+#endif
+#embed "missing.bin"
+#embed "embed/abc.bin" limit(-1)
+#embed "embed/abc.bin" limit(1) limit(2)
+#embed "embed/abc.bin" unknown(1)
+#embed
+#embed "
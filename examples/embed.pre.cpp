@@ -0,0 +1,26 @@
+
+
+const unsigned char all[] = {
+65,66,67
+};
+const unsigned char limited[] = {
+0x00,65,66, 0xff
+};
+const unsigned char empty[] = {
+0
+};
+
+int found;
+
+
+int empty;
+
+
+int unknown;
+
+
+
+
+
+
+
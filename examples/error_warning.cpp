@@ -0,0 +1,10 @@
+#if 0
+#error "skipped"
+#warning skipped
+#endif
+#warning "deprecated header" // use new.h
+#ifndef PLATFORM
+#error "unsupported platform"
+#endif
+#error
+const int v = 1;
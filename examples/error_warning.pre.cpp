@@ -0,0 +1,10 @@
+
+
+
+
+
+
+
+
+
+const int v = 1;
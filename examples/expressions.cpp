@@ -0,0 +1,22 @@
+#define FOO_VERSION 3
+#define MAX(a, b) ((a) > (b) ? (a) : (b))
+
+#if FOO_VERSION >= 3 && !BAR
+const int A = 1;
+#endif
+
+#if MAX(FOO_VERSION, 5) == 5 && (1 << 4) / 2 - 7 == 1
+const int B = 2;
+#endif
+
+#if -1 > 18446744073709551615 - 1
+const int C = 3;
+#endif
+
+#if FOO_VERSION % 2 ? 0 : 1
+const int D = 4;
+#endif
+
+#if 0x10 == 16 && 0755 == 493 && 0b11 == 3 && 10UL == 10 && 1'000 == 1000 && 'A' == 65 && L'\x41' == 'A'
+const int E = 5;
+#endif
@@ -0,0 +1,22 @@
+
+
+
+
+const int A = 1;
+
+
+
+const int B = 2;
+
+
+
+const int C = 3;
+
+
+
+
+
+
+
+const int E = 5;
+
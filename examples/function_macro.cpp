@@ -0,0 +1,18 @@
+#define MAX(a,b) ((a)>(b)?(a):(b))
+#define ID(x) x
+#define EMPTY()
+#define F(x, y) x + y
+#define G F
+#define f(a) a*g
+#define g(a) f(a)
+
+int m = MAX(1, 2);
+int n = MAX(MAX(1, 2), (3, 4));
+int i = ID(ID)(5);
+int e = EMPTY()1;
+int s = G(1, 2);
+int r = f(2)(9);
+int l = F(1,
+          2);
+int o = ID;
+int c = F("a,b", ',');
@@ -0,0 +1,18 @@
+
+
+
+
+
+
+
+
+int m = ((1)>(2)?(1):(2));
+int n = ((((1)>(2)?(1):(2)))>((3, 4))?(((1)>(2)?(1):(2))):((3, 4)));
+int i = ID(5);
+int e = 1;
+int s = 1 + 2;
+int r = 2*9*g;
+int l = 1 + 2;
+
+int o = ID;
+int c = "a,b" + ',';
@@ -0,0 +1,6 @@
+#include "once_warning.h"
+#include "once_warning.h"
+#include "guarded.h"
+#include "guarded.h"
+#undef GUARDED_H
+#include "guarded.h"
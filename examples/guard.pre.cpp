@@ -0,0 +1,23 @@
+
+
+int once_warning;
+
+
+/* a classic include guard */
+
+
+
+int guarded;
+
+
+
+
+
+/* a classic include guard */
+
+
+
+int guarded;
+
+
+
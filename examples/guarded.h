@@ -0,0 +1,7 @@
+/* a classic include guard */
+#ifndef GUARDED_H
+#define GUARDED_H
+#if 1
+int guarded;
+#endif
+#endif // GUARDED_H
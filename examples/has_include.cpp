@@ -0,0 +1,16 @@
+#define once 0
+#define HEADER "not_once.h"
+#if __has_include("once.h") && __has_include(<not_once.h>)
+int both;
+#endif
+#if __has_include("missing.h")
+int missing;
+#elif __has_include(HEADER)
+int header;
+#endif
+#ifdef __has_include
+int has_include;
+#endif
+#if defined(__has_include_next) && __has_include_next(<once.h>)
+int next;
+#endif
@@ -0,0 +1,16 @@
+
+
+
+int both;
+
+
+
+
+int header;
+
+
+int has_include;
+
+
+int next;
+
@@ -0,0 +1 @@
+int after_d;
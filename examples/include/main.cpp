@@ -0,0 +1,5 @@
+#include "sub/a.h"
+#include "q.h"
+#include <q.h>
+#include <c.h>
+#include <d.h>
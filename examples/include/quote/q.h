@@ -0,0 +1 @@
+int quote_q;
@@ -0,0 +1 @@
+int sub_b;
@@ -0,0 +1 @@
+int system_b;
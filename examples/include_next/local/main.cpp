@@ -0,0 +1 @@
+#include "x.h"
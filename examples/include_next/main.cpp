@@ -0,0 +1,3 @@
+#include <stdio.h>
+#include <only.h>
+#include_next <stdio.h>
@@ -0,0 +1,3 @@
+#if !__has_include_next(<only.h>)
+int only;
+#endif
@@ -0,0 +1,4 @@
+#if __has_include_next(<stdio.h>)
+#include_next <stdio.h>
+#endif
+int wrap;
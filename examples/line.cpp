@@ -0,0 +1,10 @@
+#define BASE 100
+int a;
+#line 42
+int b;
+#line BASE "other.c"
+int c;
+# 7 "gnu.c" 2
+int d;
+#warning "here"
+#line 5 "
@@ -0,0 +1,10 @@
+
+int a;
+
+int b;
+
+int c;
+
+int d;
+
+
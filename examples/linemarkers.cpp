@@ -0,0 +1,9 @@
+#include "not_once.h"
+int a;
+#if 0
+int b;
+#endif
+int c;
+int e; _Pragma("omp parallel for") int f;
+#line 100 "other.c"
+int d;
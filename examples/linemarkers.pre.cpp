@@ -0,0 +1,15 @@
+# 1 "linemarkers.cpp"
+# 1 "not_once.h" 1
+const int v = 1;
+# 2 "linemarkers.cpp" 2
+int a;
+
+
+# 6 "linemarkers.cpp"
+int c;
+int e; 
+#pragma omp parallel for
+# 7 "linemarkers.cpp"
+ int f;
+# 100 "other.c"
+int d;
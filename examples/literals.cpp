@@ -0,0 +1,18 @@
+#define NAME x
+#define L wide
+#define R raw
+#define u8 utf8
+#define STR(a) #a
+const char *a = "NAME";
+const char b = 'N';
+const wchar_t *c = L"NAME";
+const char *d = u8"NAME" "\"NAME\"";
+const char *e = R"delim(NAME " NAME
+// not a comment
+#define NAME y
+)delim";
+const char *f = LR"(NAME)";
+const char32_t g = U'N';
+int NAME = L + R + u8;
+const char *h = "/* NAME */" NAME "// NAME";
+const char *i = STR(R"(a"b)");
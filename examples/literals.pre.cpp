@@ -0,0 +1,18 @@
+
+
+
+
+
+const char *a = "NAME";
+const char b = 'N';
+const wchar_t *c = L"NAME";
+const char *d = u8"NAME" "\"NAME\"";
+const char *e = R"delim(NAME " NAME
+// not a comment
+#define NAME y
+)delim";
+const char *f = LR"(NAME)";
+const char32_t g = U'N';
+int x = wide + raw + utf8;
+const char *h = "/* NAME */" x "// NAME";
+const char *i = "R\"(a\"b)\"";
@@ -0,0 +1,3 @@
+#pragma once
+#warning "once_warning.h processed"
+int once_warning;
@@ -0,0 +1,17 @@
+#define N 4
+#pragma pack(push, N) // comment
+#pragma omp parallel for
+#pragma message("building " N)
+#pragma region Helpers
+#define DO_PRAGMA(x) _Pragma(#x)
+int a; DO_PRAGMA(omp parallel for) int b;
+_Pragma("GCC diagnostic push")
+_Pragma("message(\"from _Pragma\")")
+#if 0
+#pragma message("skipped")
+#endif
+_Pragma(1)
+_Pragma("
+)
+_Pragma(L")
+)
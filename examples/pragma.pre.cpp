@@ -0,0 +1,19 @@
+
+#pragma pack(push, N)
+#pragma omp parallel for
+
+// #pragma region Helpers
+
+int a; 
+#pragma omp parallel for
+ int b;
+#pragma GCC diagnostic push
+
+
+
+
+_Pragma(1)
+_Pragma("
+)
+_Pragma(L")
+)
@@ -0,0 +1,12 @@
+#define min(a, b) ((a) < (b) ? (a) : (b))
+#pragma push_macro("min")
+#undef min
+int min = 0;
+#pragma pop_macro("min")
+int m = min(1, 2);
+#pragma push_macro("undefined")
+#define undefined 1
+#pragma pop_macro("undefined")
+int u = undefined;
+#pragma pop_macro("min")
+#pragma push_macro(min)
@@ -0,0 +1,12 @@
+
+
+
+int min = 0;
+
+int m = ((1) < (2) ? (1) : (2));
+
+
+
+int u = undefined;
+
+
@@ -0,0 +1,22 @@
+#define STR(x) #x
+#define XSTR(x) STR(x)
+#define CAT(a, b) a ## b
+#define CAT3(a, b, c) a ## b ## c
+#define FOO 42
+#define NAME(n) get_ ## n ## _value
+#define DECL(type, n) type n = CAT(n, _init); const char *n##_name = #n
+
+const char *a = STR(hello   world);
+const char *b = STR( "quoted \n" 'c' '\'' );
+const char *c = STR(FOO);
+const char *d = XSTR(FOO);
+const char *e = STR();
+int f = CAT(F, OO);
+int g = CAT(1, 2);
+int h = CAT(, x);
+int i = CAT(y, );
+int j = CAT3(, , );
+int k = CAT3(a, , c);
+int l = NAME(width)();
+DECL(int, count);
+int m = CAT(<, <=) 1;
@@ -0,0 +1,22 @@
+
+
+
+
+
+
+
+
+const char *a = "hello world";
+const char *b = "\"quoted \\n\" 'c' '\\''";
+const char *c = "FOO";
+const char *d = "42";
+const char *e = "";
+int f = 42;
+int g = 12;
+int h = x;
+int i = y;
+int j = ;
+int k = ac;
+int l = get_width_value();
+int count = count_init; const char *count_name = "count";
+int m = <<= 1;
@@ -0,0 +1,16 @@
+#define LOG(fmt, ...) printf(fmt, __VA_ARGS__)
+#define LOG_OPT(fmt, ...) printf(fmt __VA_OPT__(,) __VA_ARGS__)
+#define LOG_GNU(fmt, args...) printf(fmt, ## args)
+#define LOG_COMMA(fmt, ...) printf(fmt, ##__VA_ARGS__)
+#define COUNT(...) count(__VA_ARGS__)
+#define TWO 2
+
+LOG("%d %d", 1, TWO);
+LOG_OPT("none");
+LOG_OPT("one %d", 1);
+LOG_GNU("none");
+LOG_GNU("two %d %d", 1, (2, 3));
+LOG_COMMA("none");
+LOG_COMMA("one %d", TWO);
+COUNT();
+COUNT(a, b, c);
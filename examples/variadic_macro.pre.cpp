@@ -0,0 +1,16 @@
+
+
+
+
+
+
+
+printf("%d %d", 1, 2);
+printf("none"  );
+printf("one %d" , 1);
+printf("none");
+printf("two %d %d",1, (2, 3));
+printf("none");
+printf("one %d",2);
+count();
+count(a, b, c);
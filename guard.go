@@ -0,0 +1,110 @@
+package cpre
+
+// directiveLine returns the non-space tokens of the directive starting at
+// ts[i], which must be a # at the start of a line, and the index following
+// the line.
+func directiveLine(ts []token, i int) ([]token, int) {
+	var line []token
+
+	for i++; i < len(ts) && ts[i].kind != tokenKindNewline; i++ {
+		if ts[i].kind != tokenKindSpace {
+			line = append(line, ts[i])
+		}
+	}
+
+	return line, i
+}
+
+// guardMacro returns the macro name of the condition of an include guard,
+// #ifndef X or #if !defined(X), if the directive is one.
+func guardMacro(line []token) string {
+	texts := make([]string, len(line))
+	for i, t := range line {
+		texts[i] = t.text
+	}
+
+	switch {
+	case len(line) == 2 && texts[0] == "ifndef" && line[1].kind == tokenKindID:
+		return texts[1]
+	case len(line) == 4 && texts[0] == "if" && texts[1] == "!" && texts[2] == "defined" && line[3].kind == tokenKindID:
+		return texts[3]
+	case len(line) == 6 && texts[0] == "if" && texts[1] == "!" && texts[2] == "defined" && texts[3] == "(" && line[4].kind == tokenKindID && texts[5] == ")":
+		return texts[4]
+	}
+
+	return ""
+}
+
+// detectGuard returns the macro name of the include guard of a file, i.e.
+// the file consists of a single #ifndef X ... #endif block with only
+// whitespace and comments around it, or "" if it has none; once the file has
+// been processed, it need not be processed again while X is defined.
+func detectGuard(source []byte) string {
+	ts := tokenize(string(source))
+
+	guard := ""
+	depth := 0
+	closed := false
+	bol := true
+
+	for i := 0; i < len(ts); i++ {
+		t := ts[i]
+
+		switch t.kind {
+		case tokenKindSpace:
+			continue
+		case tokenKindNewline:
+			bol = true
+			continue
+		}
+
+		if closed {
+			// anything following the #endif of the guard
+			return ""
+		}
+
+		if !bol || t.text != "#" {
+			if guard == "" {
+				return ""
+			}
+
+			bol = false
+			continue
+		}
+
+		line, next := directiveLine(ts, i)
+		i = next - 1
+
+		if guard == "" {
+			guard = guardMacro(line)
+			if guard == "" {
+				return ""
+			}
+
+			depth = 1
+			continue
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0].text {
+		case "if", "ifdef", "ifndef":
+			depth++
+		case "elif", "else":
+			if depth == 1 {
+				return ""
+			}
+		case "endif":
+			depth--
+			closed = depth == 0
+		}
+	}
+
+	if !closed {
+		return ""
+	}
+
+	return guard
+}
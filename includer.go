@@ -0,0 +1,162 @@
+package cpre
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Includer resolves an #include; global is set for the <...> form and
+// includer is the id of the including file, "" for a source without one.
+//
+// The returned index is the index of the search path the file was found in,
+// or -1 if it was not found in a search path; for #include_next, from is
+// the index of the search path to start searching at, otherwise it is -1.
+type Includer func(filePath string, global bool, includer string, from int) (id string, index int, source []byte, err error)
+
+// IncluderConfig lists the directories searched for included files, like the
+// GCC options of the same names.
+type IncluderConfig struct {
+	// Quote lists the directories searched for "..." includes only (-iquote).
+	Quote []string
+	// Paths lists the directories searched for both forms (-I).
+	Paths []string
+	// System lists the directories searched after Paths (-isystem).
+	System []string
+	// After lists the directories searched last (-idirafter).
+	After []string
+
+	// Overlay maps paths to contents read instead of the files, e.g. unsaved
+	// editor buffers; files that only exist in the overlay are found too.
+	// The paths are normalized like the ids of the includer.
+	Overlay map[string][]byte
+}
+
+// searchDir is a directory searched for an include with the index of its
+// search path, -1 for the directory of the including file.
+type searchDir struct {
+	dir   string
+	index int
+}
+
+// dirs returns the directories searched for an include, in order; "..."
+// includes are first looked up in the directory of the including file, as
+// returned by dir, and the search paths are indexed in the order Quote,
+// Paths, System, After.
+func (c IncluderConfig) dirs(global bool, includer string, from int, dir func(string) string) []searchDir {
+	var paths []string
+	paths = append(paths, c.Quote...)
+	paths = append(paths, c.Paths...)
+	paths = append(paths, c.System...)
+	paths = append(paths, c.After...)
+
+	var dirs []searchDir
+
+	start := 0
+	switch {
+	case from >= 0:
+		start = from
+	case global:
+		start = len(c.Quote)
+	case includer != "":
+		dirs = append(dirs, searchDir{dir(includer), -1})
+	}
+
+	for i := start; i < len(paths); i++ {
+		dirs = append(dirs, searchDir{paths[i], i})
+	}
+
+	return dirs
+}
+
+// NewIncluder returns an includer that searches the given directories for
+// both forms of #include.
+func NewIncluder(paths []string) Includer {
+	return NewIncluderWithConfig(IncluderConfig{
+		Paths: paths,
+	})
+}
+
+// NewIncluderWithConfig returns an includer that searches the directories of
+// the config; ids are absolute paths.
+func NewIncluderWithConfig(config IncluderConfig) Includer {
+	overlay := make(map[string][]byte, len(config.Overlay))
+	for p, bs := range config.Overlay {
+		if id, err := filepath.Abs(p); err == nil {
+			p = id
+		}
+
+		overlay[p] = bs
+	}
+
+	return func(name string, global bool, includer string, from int) (string, int, []byte, error) {
+		for _, dir := range config.dirs(global, includer, from, filepath.Dir) {
+			ip := filepath.Join(dir.dir, name)
+
+			id, err := filepath.Abs(ip)
+			if err != nil {
+				return "", -1, nil, errors.Wrapf(err, "failed to resolve #include file: '%s'", name)
+			}
+
+			if bs, ok := overlay[id]; ok {
+				return id, dir.index, bs, nil
+			}
+
+			bs, err := os.ReadFile(ip)
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			if err != nil {
+				return "", -1, nil, errors.Wrapf(err, "failed to read #include file: '%s'", name)
+			}
+
+			return id, dir.index, bs, nil
+		}
+
+		return "", -1, nil, errors.Errorf("failed to find #include file: '%s'", name)
+	}
+}
+
+// NewFSIncluder is like NewIncluder, but reads the included files from fsys,
+// e.g. an embed.FS; paths and ids are slash-separated paths within fsys.
+func NewFSIncluder(fsys fs.FS, paths []string) Includer {
+	return NewFSIncluderWithConfig(fsys, IncluderConfig{
+		Paths: paths,
+	})
+}
+
+// NewFSIncluderWithConfig is like NewIncluderWithConfig, but reads the
+// included files from fsys.
+func NewFSIncluderWithConfig(fsys fs.FS, config IncluderConfig) Includer {
+	overlay := make(map[string][]byte, len(config.Overlay))
+	for p, bs := range config.Overlay {
+		overlay[path.Clean(p)] = bs
+	}
+
+	return func(name string, global bool, includer string, from int) (string, int, []byte, error) {
+		for _, dir := range config.dirs(global, includer, from, path.Dir) {
+			id := path.Join(dir.dir, name)
+
+			if bs, ok := overlay[id]; ok {
+				return id, dir.index, bs, nil
+			}
+
+			bs, err := fs.ReadFile(fsys, id)
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+				continue
+			}
+
+			if err != nil {
+				return "", -1, nil, errors.Wrapf(err, "failed to read #include file: '%s'", name)
+			}
+
+			return id, dir.index, bs, nil
+		}
+
+		return "", -1, nil, errors.Errorf("failed to find #include file: '%s'", name)
+	}
+}
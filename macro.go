@@ -0,0 +1,610 @@
+package cpre
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type macro struct {
+	name     string
+	function bool
+	variadic bool
+	params   []string
+	body     []token
+
+	// builtin computes the replacement of a predefined dynamic macro, e.g.
+	// __LINE__, on each expansion
+	builtin func(s *state) string
+	// fn computes the replacement of a macro defined with DefineFunc
+	fn MacroFunc
+}
+
+// parseMacro parses a macro definition in the form used by #define, i.e.
+// the macro name, an optional parameter list and the replacement list.
+func parseMacro(definition string) (*macro, error) {
+	ts := tokenize(definition)
+
+	i := 0
+	for i < len(ts) && ts[i].kind == tokenKindSpace {
+		i++
+	}
+
+	if i == len(ts) || ts[i].kind != tokenKindID {
+		return nil, errors.New("macro name must be an identifier")
+	}
+
+	m := &macro{
+		name: ts[i].text,
+	}
+	i++
+
+	if i < len(ts) && ts[i].text == "(" {
+		m.function = true
+		i++
+
+		expectParam := true
+		for {
+			for i < len(ts) && ts[i].kind == tokenKindSpace {
+				i++
+			}
+
+			if i == len(ts) {
+				return nil, errors.Errorf("missing ')' in macro parameter list: '%s'", m.name)
+			}
+
+			t := ts[i]
+			i++
+
+			if m.variadic && t.text != ")" {
+				return nil, errors.Errorf("missing ')' after '...' in macro parameter list: '%s'", m.name)
+			}
+
+			switch {
+			case t.text == ")" && (!expectParam || len(m.params) == 0):
+			case t.text == "..." && expectParam:
+				m.params = append(m.params, "__VA_ARGS__")
+				m.variadic = true
+				expectParam = false
+				continue
+			case t.text == "..." && !expectParam:
+				// GNU named variadic parameter, e.g. args...
+				m.variadic = true
+				continue
+			case t.kind == tokenKindID && expectParam:
+				if t.text == "__VA_ARGS__" {
+					return nil, errors.New("__VA_ARGS__ can not be used as a parameter name")
+				}
+
+				for _, p := range m.params {
+					if p == t.text {
+						return nil, errors.Errorf("duplicate macro parameter: '%s'", t.text)
+					}
+				}
+				m.params = append(m.params, t.text)
+				expectParam = false
+				continue
+			case t.text == "," && !expectParam:
+				expectParam = true
+				continue
+			default:
+				return nil, errors.Errorf("unexpected '%s' in macro parameter list: '%s'", t.text, m.name)
+			}
+
+			break
+		}
+	}
+
+	for i < len(ts) && ts[i].kind == tokenKindSpace && !strings.HasPrefix(ts[i].text, "/") {
+		i++
+	}
+
+	m.body = ts[i:]
+
+	if m.function {
+		for i, t := range m.body {
+			if t.text != "#" {
+				continue
+			}
+
+			j := nextNonSpace(m.body, i+1)
+			if j == len(m.body) || m.param(m.body[j].text) < 0 && !(m.variadic && m.body[j].text == "__VA_OPT__") {
+				return nil, errors.Errorf("'#' is not followed by a macro parameter: '%s'", m.name)
+			}
+		}
+	}
+
+	if body := trimSpace(m.body); len(body) > 0 {
+		if body[0].text == "##" || body[len(body)-1].text == "##" {
+			return nil, errors.Errorf("'##' cannot appear at either end of a macro expansion: '%s'", m.name)
+		}
+	}
+
+	return m, nil
+}
+
+// vaOptEnd returns the index of the parenthesis closing a __VA_OPT__ whose
+// opening parenthesis is at ts[start].
+func vaOptEnd(ts []token, start int) int {
+	depth := 0
+	for i := start; i < len(ts); i++ {
+		switch ts[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func trimPlacemarker(ts []token) []token {
+	if len(ts) > 0 && ts[len(ts)-1].kind == tokenKindPlacemarker {
+		return ts[:len(ts)-1]
+	}
+
+	return ts
+}
+
+// nextNonSpace returns the index of the first token at or after i that is
+// not whitespace.
+func nextNonSpace(ts []token, i int) int {
+	for i < len(ts) && (ts[i].kind == tokenKindSpace || ts[i].kind == tokenKindNewline) {
+		i++
+	}
+
+	return i
+}
+
+// equal reports whether two definitions of a macro are identical, ignoring
+// differences in whitespace.
+func (m *macro) equal(other *macro) bool {
+	if m.builtin != nil || other.builtin != nil || m.fn != nil || other.fn != nil {
+		return false
+	}
+
+	if m.function != other.function || m.variadic != other.variadic || strings.Join(m.params, ",") != strings.Join(other.params, ",") {
+		return false
+	}
+
+	return spelling(m.body) == spelling(other.body)
+}
+
+// spelling renders tokens with each run of whitespace collapsed into a
+// single space.
+func spelling(ts []token) string {
+	var sb strings.Builder
+
+	space := false
+	for _, t := range trimSpace(ts) {
+		if t.kind == tokenKindSpace || t.kind == tokenKindNewline {
+			space = true
+			continue
+		}
+
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+
+		sb.WriteString(t.text)
+	}
+
+	return sb.String()
+}
+
+func (m *macro) param(id string) int {
+	for i, p := range m.params {
+		if p == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+type expanderMark struct {
+	ts       []token
+	end      int
+	newlines int
+}
+
+// expander performs macro replacement on a list of pending tokens; when
+// source is set, tokens needed to complete a function-like macro invocation
+// are read from the state's buffer.
+type expander struct {
+	s      *state
+	source bool
+
+	ts       []token
+	newlines int
+}
+
+func (s *state) expandTokens(ts []token) []token {
+	e := &expander{
+		s:  s,
+		ts: ts,
+	}
+
+	return e.expand()
+}
+
+func (e *expander) mark() expanderMark {
+	m := expanderMark{
+		ts:       e.ts,
+		newlines: e.newlines,
+	}
+
+	if e.source {
+		m.end = e.s.end
+	}
+
+	return m
+}
+
+func (e *expander) reset(m expanderMark) {
+	e.ts = m.ts
+	e.newlines = m.newlines
+
+	if e.source {
+		e.s.end = m.end
+	}
+}
+
+func (e *expander) next() (token, bool) {
+	if len(e.ts) > 0 {
+		t := e.ts[0]
+		e.ts = e.ts[1:]
+		return t, true
+	}
+
+	if e.source && e.s.end < len(e.s.s) {
+		var t token
+		t, e.s.end = scanToken(e.s.s, e.s.end)
+		e.newlines += strings.Count(t.text, "\n")
+		return t, true
+	}
+
+	return token{}, false
+}
+
+// readParen consumes whitespace and an opening parenthesis, if present.
+func (e *expander) readParen() bool {
+	for {
+		t, ok := e.next()
+		if !ok {
+			return false
+		}
+
+		switch t.kind {
+		case tokenKindSpace, tokenKindNewline:
+			continue
+		}
+
+		return t.text == "("
+	}
+}
+
+// readArgs collects the arguments of a function-like macro invocation up to
+// and including the closing parenthesis.
+func (e *expander) readArgs(m *macro) ([][]token, token, error) {
+	var args [][]token
+	var arg []token
+
+	depth := 0
+	for {
+		t, ok := e.next()
+		if !ok {
+			return nil, token{}, errors.Errorf("unterminated argument list invoking macro: '%s'", m.name)
+		}
+
+		switch t.kind {
+		case tokenKindNewline:
+			t = token{kind: tokenKindSpace, text: " ", hide: t.hide}
+		case tokenKindSpace:
+			if strings.HasPrefix(t.text, "//") || strings.Contains(t.text, "\n") {
+				t.text = " "
+			}
+		case tokenKindPunct:
+			switch t.text {
+			case "(":
+				depth++
+			case ")":
+				if depth == 0 {
+					args = append(args, trimSpace(arg))
+
+					if len(m.params) == 0 && len(args) == 1 && len(args[0]) == 0 {
+						args = nil
+					}
+
+					if m.variadic && len(args) == len(m.params)-1 {
+						// the variable arguments may be omitted entirely
+						args = append(args, nil)
+					}
+
+					if len(args) != len(m.params) {
+						return nil, token{}, errors.Errorf("macro '%s' requires %d arguments, but %d given", m.name, len(m.params), len(args))
+					}
+
+					return args, t, nil
+				}
+				depth--
+			case ",":
+				if depth == 0 && !(m.variadic && len(args) == len(m.params)-1) {
+					args = append(args, trimSpace(arg))
+					arg = nil
+					continue
+				}
+			}
+		}
+
+		arg = append(arg, t)
+	}
+}
+
+// invocation holds the arguments of a function-like macro invocation; the
+// arguments are fully macro-expanded on first use.
+type invocation struct {
+	m        *macro
+	args     [][]token
+	expanded [][]token
+}
+
+func (in *invocation) expand(s *state, i int) []token {
+	if in.expanded[i] == nil {
+		in.expanded[i] = append([]token{}, s.expandTokens(append([]token{}, in.args[i]...))...)
+	}
+
+	return in.expanded[i]
+}
+
+// subst builds the replacement list of an invocation of m, substituting the
+// fully expanded arguments for the parameters.
+func (e *expander) subst(m *macro, args [][]token, hs hideset) []token {
+	in := &invocation{
+		m:        m,
+		args:     args,
+		expanded: make([][]token, len(args)),
+	}
+
+	body := e.substTokens(in, m.body)
+
+	var result []token
+	for _, t := range body {
+		if t.kind == tokenKindPlacemarker {
+			continue
+		}
+
+		t.hide = t.hide.union(hs)
+		result = append(result, t)
+	}
+
+	return result
+}
+
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// stringize implements the # operator: the argument's spelling becomes a
+// string literal with whitespace collapsed and quotes and backslashes
+// within literals escaped.
+func stringize(arg []token) token {
+	var escaped []token
+	for _, t := range arg {
+		switch t.kind {
+		case tokenKindString, tokenKindChar:
+			t.text = stringEscaper.Replace(t.text)
+		}
+		escaped = append(escaped, t)
+	}
+
+	return token{
+		kind: tokenKindString,
+		text: `"` + spelling(escaped) + `"`,
+	}
+}
+
+// paste implements the ## operator by concatenating the spelling of two
+// tokens; ok is false when the result is not a single valid token.
+func paste(left, right token) ([]token, bool) {
+	ts := tokenize(left.text + right.text)
+	if len(ts) != 1 {
+		return []token{left, right}, false
+	}
+
+	return ts, true
+}
+
+func (e *expander) substTokens(in *invocation, body []token) []token {
+	var result []token
+
+	m := in.m
+	va := len(m.params) - 1
+
+	for i := 0; i < len(body); i++ {
+		t := body[i]
+
+		if m.variadic && t.text == "," {
+			// GNU extension: ", ## __VA_ARGS__" swallows the comma when the
+			// variable arguments are empty
+			j := nextNonSpace(body, i+1)
+			if j < len(body) && body[j].text == "##" {
+				k := nextNonSpace(body, j+1)
+				if k < len(body) && body[k].kind == tokenKindID && m.param(body[k].text) == va {
+					if len(in.args[va]) > 0 {
+						result = append(result, t)
+						result = append(result, in.args[va]...)
+					}
+					i = k
+					continue
+				}
+			}
+		}
+
+		if m.function && t.text == "#" {
+			j := nextNonSpace(body, i+1)
+			if j < len(body) && body[j].kind == tokenKindID {
+				if p := m.param(body[j].text); p >= 0 {
+					result = append(result, stringize(in.args[p]))
+					i = j
+					continue
+				}
+
+				if m.variadic && body[j].text == "__VA_OPT__" {
+					k := nextNonSpace(body, j+1)
+					if end := vaOptEnd(body, k); k < len(body) && body[k].text == "(" && end >= 0 {
+						var content []token
+						if len(trimSpace(in.expand(e.s, va))) > 0 {
+							content = e.substTokens(in, body[k+1:end])
+						}
+						result = append(result, stringize(content))
+						i = end
+						continue
+					}
+				}
+			}
+		}
+
+		if t.text == "##" {
+			j := nextNonSpace(body, i+1)
+			if j == len(body) {
+				continue
+			}
+
+			right := []token{body[j]}
+			if body[j].kind == tokenKindID {
+				if p := m.param(body[j].text); p >= 0 {
+					right = in.args[p]
+				}
+			}
+			i = j
+
+			for len(result) > 0 && (result[len(result)-1].kind == tokenKindSpace || result[len(result)-1].kind == tokenKindNewline) {
+				result = result[:len(result)-1]
+			}
+
+			switch {
+			case len(right) == 0:
+				if len(result) == 0 {
+					result = append(result, token{kind: tokenKindPlacemarker})
+				}
+			case len(result) == 0 || result[len(result)-1].kind == tokenKindPlacemarker:
+				result = append(trimPlacemarker(result), right...)
+			default:
+				left := result[len(result)-1]
+				pasted, ok := paste(left, right[0])
+				if !ok {
+					e.s.errorf("pasting '%s' and '%s' does not give a valid preprocessing token", left.text, right[0].text)
+				}
+				result = append(append(result[:len(result)-1], pasted...), right[1:]...)
+			}
+			continue
+		}
+
+		if t.kind == tokenKindID {
+			if m.variadic && t.text == "__VA_OPT__" {
+				j := nextNonSpace(body, i+1)
+				if j < len(body) && body[j].text == "(" {
+					if end := vaOptEnd(body, j); end >= 0 {
+						if len(trimSpace(in.expand(e.s, va))) > 0 {
+							result = append(result, e.substTokens(in, body[j+1:end])...)
+						}
+						i = end
+						continue
+					}
+				}
+			}
+
+			if p := m.param(t.text); p >= 0 {
+				if j := nextNonSpace(body, i+1); j < len(body) && body[j].text == "##" {
+					// operands of ## are not macro-expanded
+					if len(in.args[p]) == 0 {
+						result = append(result, token{kind: tokenKindPlacemarker})
+					} else {
+						result = append(result, in.args[p]...)
+					}
+					continue
+				}
+
+				result = append(result, in.expand(e.s, p)...)
+				continue
+			}
+		}
+
+		result = append(result, t)
+	}
+
+	return result
+}
+
+func (e *expander) expand() []token {
+	var result []token
+
+	for len(e.ts) > 0 {
+		t := e.ts[0]
+		e.ts = e.ts[1:]
+
+		if t.kind != tokenKindID || t.hide[t.text] {
+			result = append(result, t)
+			continue
+		}
+
+		if t.text == "_Pragma" {
+			if ts, ok := e.pragmaOperator(); ok {
+				result = append(result, ts...)
+				continue
+			}
+		}
+
+		m, ok := e.s.p.defines[t.text]
+		if !ok {
+			result = append(result, t)
+			continue
+		}
+
+		if m.builtin != nil {
+			result = append(result, tokenize(m.builtin(e.s))...)
+			continue
+		}
+
+		if !m.function && m.fn != nil {
+			e.ts = append(e.call(m, nil, t.hide.with(m.name)), e.ts...)
+			continue
+		}
+
+		if !m.function {
+			e.ts = append(e.subst(m, nil, t.hide.with(m.name)), e.ts...)
+			continue
+		}
+
+		mark := e.mark()
+
+		if !e.readParen() {
+			e.reset(mark)
+			result = append(result, t)
+			continue
+		}
+
+		args, rparen, err := e.readArgs(m)
+		if err != nil {
+			e.s.errorf("%s", err)
+			e.reset(mark)
+			result = append(result, t)
+			continue
+		}
+
+		hs := t.hide.intersect(rparen.hide).with(m.name)
+
+		if m.fn != nil {
+			e.ts = append(e.call(m, args, hs), e.ts...)
+			continue
+		}
+
+		e.ts = append(e.subst(m, args, hs), e.ts...)
+	}
+
+	return result
+}
@@ -0,0 +1,182 @@
+package cpre
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// builtinPragmas lists the pragmas handled by the preprocessor itself, which
+// cannot be registered.
+var builtinPragmas = map[string]bool{
+	"once":       true,
+	"push_macro": true,
+	"pop_macro":  true,
+}
+
+// PragmaContext describes a #pragma directive or _Pragma operator.
+type PragmaContext struct {
+	// Namespace is the first token of the pragma, e.g. "pack" or "omp".
+	Namespace string
+	// Value is the rest of the pragma following the namespace, with comments
+	// and surrounding whitespace removed.
+	Value string
+	// Text is the pragma as it is written to the output when not handled,
+	// e.g. #pragma pack(1).
+	Text string
+
+	File   string
+	Line   int
+	Column int
+
+	s *state
+}
+
+func (c *PragmaContext) Errorf(format string, args ...interface{}) {
+	c.s.reportAt(c.Line, c.Column, SeverityError, format, args...)
+}
+
+func (c *PragmaContext) Warningf(format string, args ...interface{}) {
+	c.s.reportAt(c.Line, c.Column, SeverityWarning, format, args...)
+}
+
+// PragmaHandler handles the pragmas of a namespace; the returned text
+// replaces the pragma in the output, so return ctx.Text to keep it, and an
+// error is reported as a diagnostic.
+type PragmaHandler func(ctx *PragmaContext) (string, error)
+
+// RegisterPragma registers a handler for the pragmas of a namespace, e.g.
+// "pack" for #pragma pack(1); pragmas without a handler are kept in the
+// output.
+func (p *Preprocessor) RegisterPragma(namespace string, handler PragmaHandler) error {
+	if ts := tokenize(namespace); len(ts) != 1 || ts[0].kind != tokenKindID {
+		return errors.Errorf("invalid pragma namespace: '%s'", namespace)
+	}
+
+	if builtinPragmas[namespace] {
+		return errors.Errorf("cannot register builtin pragma: '%s'", namespace)
+	}
+
+	p.pragmas[namespace] = handler
+
+	return nil
+}
+
+// pragma handles a pragma given the text following #pragma and returns its
+// replacement in the output.
+func (s *state) pragma(text string) string {
+	text = strings.TrimSpace(text)
+
+	ts := tokenize(text)
+
+	namespace := ""
+	if len(ts) > 0 && ts[0].kind == tokenKindID {
+		namespace = ts[0].text
+		ts = ts[1:]
+	}
+
+	switch namespace {
+	case "once":
+		s.p.once[s.id] = true
+		return ""
+	case "push_macro", "pop_macro":
+		s.pragmaMacro(namespace, ts)
+		return ""
+	}
+
+	handler, ok := s.p.pragmas[namespace]
+	if !ok {
+		return "#pragma " + text
+	}
+
+	line, column := s.location(s.pos)
+
+	ctx := &PragmaContext{
+		Namespace: namespace,
+		Value:     spelling(ts),
+		Text:      "#pragma " + text,
+		File:      s.file,
+		Line:      line,
+		Column:    column,
+		s:         s,
+	}
+
+	result, err := handler(ctx)
+	if err != nil {
+		ctx.Errorf("%s", errors.Wrapf(err, "#pragma %s failed", namespace))
+		return ""
+	}
+
+	return result
+}
+
+// pragmaMacro implements #pragma push_macro("name") and
+// #pragma pop_macro("name").
+func (s *state) pragmaMacro(namespace string, ts []token) {
+	var operands []token
+	for _, t := range ts {
+		if t.kind != tokenKindSpace {
+			operands = append(operands, t)
+		}
+	}
+
+	if len(operands) != 3 || operands[0].text != "(" || operands[1].kind != tokenKindString || !strings.HasPrefix(operands[1].text, `"`) || operands[2].text != ")" {
+		s.warningf("invalid #pragma %s directive", namespace)
+		return
+	}
+
+	name := operands[1].text[1 : len(operands[1].text)-1]
+
+	if namespace == "push_macro" {
+		s.p.PushMacro(name)
+		return
+	}
+
+	if err := s.p.PopMacro(name); err != nil {
+		s.warningf("%s", err)
+	}
+}
+
+// pragmaOperator expands the _Pragma operator, whose string literal operand
+// is destringized and handled like a #pragma on a line of its own. With line
+// markers a marker follows the pragma; without them, a _Pragma sharing its
+// line with other tokens puts the following output lines out of step.
+func (e *expander) pragmaOperator() ([]token, bool) {
+	mark := e.mark()
+
+	if !e.readParen() {
+		e.reset(mark)
+		return nil, false
+	}
+
+	args, _, err := e.readArgs(&macro{name: "_Pragma", function: true, params: []string{"operand"}})
+
+	literal := ""
+	if err == nil && len(args[0]) == 1 && args[0][0].kind == tokenKindString {
+		literal = strings.TrimPrefix(args[0][0].text, "L")
+	}
+
+	if err == nil && !isStringLiteral(literal) {
+		err = errors.New("_Pragma takes a parenthesized string literal")
+	}
+
+	if err != nil {
+		e.s.errorf("%s", err)
+		e.reset(mark)
+		return nil, false
+	}
+
+	text := strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(literal[1 : len(literal)-1])
+
+	pragma := e.s.pragma(text)
+	if pragma == "" {
+		return nil, true
+	}
+
+	if e.s.p.lineMarkers {
+		line, _ := e.s.location(e.s.pos)
+		return tokenize("\n" + pragma + "\n" + e.s.marker(line, "") + "\n"), true
+	}
+
+	return tokenize("\n" + pragma + "\n"), true
+}
@@ -0,0 +1,304 @@
+package cpre
+
+import (
+	"bytes"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenKindNone tokenKind = iota
+	tokenKindSpace
+	tokenKindNewline
+	tokenKindID
+	tokenKindNumber
+	tokenKindString
+	tokenKindChar
+	tokenKindPunct
+	tokenKindPlacemarker
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	hide hideset
+}
+
+type hideset map[string]bool
+
+func (h hideset) with(id string) hideset {
+	result := make(hideset, len(h)+1)
+	for k := range h {
+		result[k] = true
+	}
+	result[id] = true
+	return result
+}
+
+func (h hideset) union(other hideset) hideset {
+	result := make(hideset, len(h)+len(other))
+	for k := range h {
+		result[k] = true
+	}
+	for k := range other {
+		result[k] = true
+	}
+	return result
+}
+
+func (h hideset) intersect(other hideset) hideset {
+	result := hideset{}
+	for k := range h {
+		if other[k] {
+			result[k] = true
+		}
+	}
+	return result
+}
+
+var punctuators = []string{
+	"...", "<<=", ">>=",
+	"##", "->", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=", "::",
+}
+
+func isIDStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isIDChar(c byte) bool {
+	return isIDStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// scanToken reads a single preprocessing token from s starting at pos
+// and returns it along with the position right after it.
+func scanToken(s []byte, pos int) (token, int) {
+	if pos >= len(s) {
+		return token{}, pos
+	}
+
+	start := pos
+	c := s[pos]
+
+	switch {
+	case c == '\n':
+		return token{kind: tokenKindNewline, text: "\n"}, pos + 1
+	case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f' || c == '/' && pos+1 < len(s) && (s[pos+1] == '/' || s[pos+1] == '*'):
+		pos = skipSpace(s, pos)
+		return token{kind: tokenKindSpace, text: string(s[start:pos])}, pos
+	case isIDStart(c):
+		if t, end, ok := scanPrefixedLiteral(s, pos); ok {
+			return t, end
+		}
+
+		for pos < len(s) && isIDChar(s[pos]) {
+			pos++
+		}
+		return token{kind: tokenKindID, text: string(s[start:pos])}, pos
+	case isDigit(c) || c == '.' && pos+1 < len(s) && isDigit(s[pos+1]):
+		pos = skipNumber(s, pos)
+		return token{kind: tokenKindNumber, text: string(s[start:pos])}, pos
+	case c == '"':
+		pos = skipQuoted(s, pos, '"')
+		return token{kind: tokenKindString, text: string(s[start:pos])}, pos
+	case c == '\'':
+		pos = skipQuoted(s, pos, '\'')
+		return token{kind: tokenKindChar, text: string(s[start:pos])}, pos
+	}
+
+	for _, p := range punctuators {
+		if bytes.HasPrefix(s[pos:], []byte(p)) {
+			return token{kind: tokenKindPunct, text: p}, pos + len(p)
+		}
+	}
+
+	return token{kind: tokenKindPunct, text: string(s[pos : pos+1])}, pos + 1
+}
+
+// skipSpace skips a run of horizontal whitespace or a single comment; block
+// comments may span lines.
+func skipSpace(s []byte, pos int) int {
+	if s[pos] == '/' {
+		if s[pos+1] == '/' {
+			for pos < len(s) && s[pos] != '\n' {
+				pos++
+			}
+			return pos
+		}
+
+		end := bytes.Index(s[pos+2:], []byte("*/"))
+		if end < 0 {
+			return len(s)
+		}
+		return pos + 2 + end + 2
+	}
+
+	for pos < len(s) {
+		switch s[pos] {
+		case ' ', '\t', '\r', '\v', '\f':
+			pos++
+		default:
+			return pos
+		}
+	}
+
+	return pos
+}
+
+func skipNumber(s []byte, pos int) int {
+	pos++
+	for pos < len(s) {
+		c := s[pos]
+		switch {
+		case (c == '+' || c == '-') && strings.ContainsRune("eEpP", rune(s[pos-1])):
+			pos++
+		case c == '\'' && pos+1 < len(s) && isIDChar(s[pos+1]):
+			pos += 2
+		case isIDChar(c) || c == '.':
+			pos++
+		default:
+			return pos
+		}
+	}
+
+	return pos
+}
+
+func skipQuoted(s []byte, pos int, quote byte) int {
+	pos++
+	for pos < len(s) {
+		switch s[pos] {
+		case '\\':
+			pos += 2
+			continue
+		case '\n':
+			return pos
+		case quote:
+			return pos + 1
+		}
+		pos++
+	}
+
+	return len(s)
+}
+
+// literalPrefixes lists the encoding and raw prefixes of string and
+// character literals, longer ones first.
+var literalPrefixes = []string{"u8R", "LR", "uR", "UR", "u8", "R", "L", "u", "U"}
+
+// scanPrefixedLiteral reads a string or character literal with a prefix,
+// e.g. L"wide", u8'c' or R"delim(raw)delim".
+func scanPrefixedLiteral(s []byte, pos int) (token, int, bool) {
+	for _, prefix := range literalPrefixes {
+		if !bytes.HasPrefix(s[pos:], []byte(prefix)) {
+			continue
+		}
+
+		q := pos + len(prefix)
+		if q >= len(s) {
+			continue
+		}
+
+		if strings.HasSuffix(prefix, "R") {
+			if s[q] != '"' {
+				continue
+			}
+
+			end, ok := skipRawString(s, q)
+			if !ok {
+				continue
+			}
+
+			return token{kind: tokenKindString, text: string(s[pos:end])}, end, true
+		}
+
+		switch s[q] {
+		case '"':
+			end := skipQuoted(s, q, '"')
+			return token{kind: tokenKindString, text: string(s[pos:end])}, end, true
+		case '\'':
+			end := skipQuoted(s, q, '\'')
+			return token{kind: tokenKindChar, text: string(s[pos:end])}, end, true
+		}
+	}
+
+	return token{}, pos, false
+}
+
+// skipRawString skips a raw string literal whose opening quote is at pos;
+// the literal may span lines and contain quotes and backslashes.
+func skipRawString(s []byte, pos int) (int, bool) {
+	open := bytes.IndexByte(s[pos+1:], '(')
+	if open < 0 || open > 16 {
+		return pos, false
+	}
+
+	delim := s[pos+1 : pos+1+open]
+	if bytes.ContainsAny(delim, " \t\n\\)\"") {
+		return pos, false
+	}
+
+	body := pos + 1 + open + 1
+	end := bytes.Index(s[body:], append(append([]byte(")"), delim...), '"'))
+	if end < 0 {
+		return len(s), true
+	}
+
+	return body + end + len(delim) + 2, true
+}
+
+// isStringLiteral reports whether text is a complete, unprefixed "..."
+// string literal; an unterminated one lexes up to the end of the line.
+func isStringLiteral(text string) bool {
+	return len(text) >= 2 && strings.HasPrefix(text, `"`) && strings.HasSuffix(text, `"`)
+}
+
+func tokenize(s string) []token {
+	var ts []token
+
+	bs := []byte(s)
+	pos := 0
+	for pos < len(bs) {
+		var t token
+		t, pos = scanToken(bs, pos)
+		ts = append(ts, t)
+	}
+
+	return ts
+}
+
+// joinTokens renders tokens back to text, separating adjacent tokens
+// that would otherwise lex as a different token when concatenated.
+func joinTokens(ts []token) string {
+	var sb strings.Builder
+
+	var prev token
+	for _, t := range ts {
+		if prev.kind != tokenKindNone && prev.kind != tokenKindSpace && prev.kind != tokenKindNewline && t.kind != tokenKindSpace && t.kind != tokenKindNewline {
+			joined := []byte(prev.text + t.text)
+			if first, _ := scanToken(joined, 0); len(first.text) != len(prev.text) {
+				sb.WriteByte(' ')
+			}
+		}
+
+		sb.WriteString(t.text)
+		prev = t
+	}
+
+	return sb.String()
+}
+
+func trimSpace(ts []token) []token {
+	for len(ts) > 0 && (ts[0].kind == tokenKindSpace || ts[0].kind == tokenKindNewline) {
+		ts = ts[1:]
+	}
+	for len(ts) > 0 && (ts[len(ts)-1].kind == tokenKindSpace || ts[len(ts)-1].kind == tokenKindNewline) {
+		ts = ts[:len(ts)-1]
+	}
+	return ts
+}